@@ -5,7 +5,7 @@ cmd=${1:-build}
 apk add linux-firmware-none linux-lts zfs-lts zfs go rsync blkid lsblk git cdrkit parted make
 
 if [ "x$cmd" == "xbuild" ]; then
-  modprobe zfs
+  modprobe -a zfs nf_tables nft_chain_nat nft_masq
   REV=$(git describe --long --tags --match='v*' --dirty 2>/dev/null || git rev-list -n1 HEAD)
   NOW=$(date +'%Y-%m-%d_%T')
   GOV=$(go version)
@@ -16,12 +16,24 @@ if [ "x$cmd" == "xbuild" ]; then
   for proto in $(find internal -name *.proto); do
     protoc --experimental_allow_proto3_optional -I $(dirname $proto) --go_out=$(dirname $proto) $(basename $proto)
   done
-  HTDOCS="`pwd`/htdocs"
-  go build -ldflags "${LDFLAGS} -X main.version=$REV -X main.buildTime=$NOW -X 'main.goVersion=${GOV}' -X main.htdocsDir=${HTDOCS}"  -o ./bin/init ./cmd
+  go build -ldflags "${LDFLAGS} -X main.version=$REV -X main.buildTime=$NOW -X 'main.goVersion=${GOV}'"  -o ./bin/init ./cmd
 
   for m in $(lsmod |awk '{print $1}'|grep -v Module); do find /lib/modules/`uname -r`/ -name "$m.ko"; done |sort|sed -r "s%^/lib/modules/$(uname -r)/%%g" > hack/mkinitfs/features.d/k8sinit.modules
-  find `pwd`/htdocs > `pwd`/hack/mkinitfs/features.d/htdocs.files
   rm -fr tmp/*
+  IPXEDIR=/usr/share/k8sinit/ipxe
+  if [ ! -f hack/ipxe/SHA256SUMS ]; then
+    echo "hack/ipxe/SHA256SUMS not found, ipxe binaries cannot be verified"
+    exit 1
+  fi
+  mkdir -p tmp/ipxe $IPXEDIR
+  for f in undionly.kpxe ipxe.efi; do
+    wget -O tmp/ipxe/$f https://boot.ipxe.org/$f
+  done
+  wget -O tmp/ipxe/ipxe-arm64.efi https://boot.ipxe.org/arm64-efi/ipxe.efi
+  (cd tmp/ipxe && sha256sum -c ../../hack/ipxe/SHA256SUMS)
+  cp hack/ipxe/SHA256SUMS tmp/ipxe/
+  cp tmp/ipxe/* $IPXEDIR/
+  find $IPXEDIR > `pwd`/hack/mkinitfs/features.d/ipxe.files
   mkdir -p tmp/iso/syslinux
   mkinitfs -o tmp/initramfs -P `pwd`/hack/mkinitfs/features.d/ -c `pwd`/hack/mkinitfs/mkinitfs.conf  -i `pwd`/bin/init
   cp -arv tmp/initramfs tmp/iso/
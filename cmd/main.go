@@ -26,7 +26,6 @@ import (
 	"github.com/kazimsarikaya/k8sinit/internal/k8sinit/system"
 	"github.com/kazimsarikaya/k8sinit/internal/k8sinit/term"
 	"github.com/pkg/errors"
-	"io/ioutil"
 	klog "k8s.io/klog/v2"
 	"os"
 	"strings"
@@ -37,7 +36,6 @@ var (
 	version   = ""
 	buildTime = ""
 	goVersion = ""
-	htdocsDir = ""
 )
 
 func init() {
@@ -70,6 +68,7 @@ func loader() error {
 	if err != nil {
 		return errors.Wrapf(err, "cannot start networking")
 	}
+	system.StartTimeSync(ic)
 	klog.V(0).Infof("feeding random")
 	rndfile := ""
 	if ic != nil {
@@ -81,26 +80,20 @@ func loader() error {
 		return errors.Wrapf(err, "cannot setup apk")
 	}
 
-	tftproot, err := ioutil.TempDir("/tmp", "tftp")
-	if err != nil {
-		return errors.Wrapf(err, "cannot create tftp root dir")
-	}
-
-	var poolName, ifname string = "", ""
-	if ic != nil {
-		poolName = ic.PoolName
-		ifname = ic.InternalNetwork
-	}
 	klog.V(0).Infof("setup management services")
-	managementServices, err := management.NewOrGetManagementServices(role, poolName, ifname, tftproot, htdocsDir)
+	managementServices, err := management.NewOrGetManagementServices(role, ic)
 	if err != nil {
 		return errors.Wrapf(err, "cannot setup management services")
 	}
 	system.SetManagementServicesStopper(managementServices)
 	managementServices.StartHttp()
 	if role == k8sinit.RoleManager {
-		managementServices.StartTftp(strings.Split(ic.InternalNetworkIPAndPrefix, "/")[0])
+		internalIP := strings.Split(ic.InternalNetworkIPAndPrefix, "/")[0]
+		managementServices.StartTftp(internalIP)
 		managementServices.StartDhcp()
+		managementServices.StartDns(internalIP)
+		managementServices.StartNtp(internalIP)
+		managementServices.StartNat()
 	}
 	return nil
 }
@@ -127,7 +120,6 @@ func showUI() error {
 			time.Sleep(time.Second * 5)
 		}
 	}
-	return nil
 }
 
 func main() {
@@ -96,25 +96,43 @@ ready(function() {
 ready(function() {
   onclick(get(".installaction a")[0], function(e) {
     e.preventDefault();
-    // Create WebSocket connection.
-    var socket = new WebSocket('ws://192.168.99.119:8000/api/system/install');
-    var installoutput = get("#installoutput")[0];
-
-    // Connection opened
-    socket.addEventListener('open', function(event) {
-      socket.send('{ "disk": "/dev/sda", "force": true,   "poolname": "zp_k8s","extnet": "eth2","adminnet":"eth0" ,"internalnet":"eth1", "internalnetip":"10.0.0.1/24"}');
-      console.log('data sended');
+    // the install websocket needs a session
+    request('GET', remote + "/api/auth/session", null, function() {
+      if (this.status != 200) {
+        return;
+      }
+      var password = prompt("admin password of the installed system");
+      if (password == null) {
+        return;
+      }
+      install(password);
+    }, function() {
+      console.log("connection error");
     });
+  });
+});
 
-    socket.addEventListener('close', function(event) {
-      console.log('transaction ended');
-    });
+function install(password) {
+  // Create WebSocket connection.
+  var socket = new WebSocket('wss://' + window.location.host + '/api/system/install');
+  var installoutput = get("#installoutput")[0];
 
-    // Listen for messages
-    socket.addEventListener('message', function(event) {
-      var line = create("div")
-      settext(line, event.data);
-      append2Parent(installoutput, line);
-    });
-  })
-});
\ No newline at end of file
+  // Connection opened
+  socket.addEventListener('open', function(event) {
+    var config = JSON.parse('{ "disk": "/dev/sda", "force": true,   "poolname": "zp_k8s","extnet": "eth2","adminnet":"eth0" ,"internalnet":"eth1", "internalnetip":"10.0.0.1/24"}');
+    config.adminpassword = password;
+    socket.send(JSON.stringify(config));
+    console.log('data sended');
+  });
+
+  socket.addEventListener('close', function(event) {
+    console.log('transaction ended');
+  });
+
+  // Listen for messages
+  socket.addEventListener('message', function(event) {
+    var line = create("div")
+    settext(line, event.data);
+    append2Parent(installoutput, line);
+  });
+}
\ No newline at end of file
@@ -1,4 +1,4 @@
-var remote = "http://192.168.99.119:8000";
+var remote = window.location.origin;
 
 function ready(fn) {
   if (document.readyState != 'loading') {
@@ -50,19 +50,55 @@ function settext(el, v) {
   el.textContent = v;
 }
 
-function request(method, endpoint, data, onloadHandler, onerrorHandler) {
+function login(onloginHandler) {
+  var password = prompt("admin password or setup token");
+  if (password == null) {
+    return;
+  }
   var request = new XMLHttpRequest();
-  request.open(method, endpoint, true);
-  request.onload = onloadHandler;
-  request.onerror = onerrorHandler;
+  request.open('POST', remote + "/api/auth/login", true);
+  request.onload = function() {
+    if (this.status == 200) {
+      onloginHandler();
+    } else {
+      console.log("login failed");
+    }
+  };
+  request.setRequestHeader('Content-Type', 'application/json; charset=UTF-8');
+  request.send(JSON.stringify({ "username": "admin", "password": password }));
+}
+
+function request(method, endpoint, data, onloadHandler, onerrorHandler) {
+  var req = new XMLHttpRequest();
+  req.open(method, endpoint, true);
+  req.onload = function() {
+    if (this.status == 401) {
+      login(function() {
+        request(method, endpoint, data, onloadHandler, onerrorHandler);
+      });
+      return;
+    }
+    onloadHandler.call(this);
+  };
+  req.onerror = onerrorHandler;
   if (data != null) {
-    request.setRequestHeader('Content-Type', 'application/json; charset=UTF-8');
-    request.send(data);
+    req.setRequestHeader('Content-Type', 'application/json; charset=UTF-8');
+    req.send(data);
   } else {
-    request.send();
+    req.send();
   }
 }
 
+function errorMessage(req) {
+  try {
+    var resp = JSON.parse(req.response);
+    if (resp.error != null) {
+      return resp.error.code + ": " + resp.error.message;
+    }
+  } catch (e) {}
+  return req.response;
+}
+
 function appendDataAsTable(parent, endpoint, title) {
 
   request('GET', remote + endpoint, null,
@@ -122,10 +158,10 @@ function appendDataAsTable(parent, endpoint, title) {
           }
         }
       } else {
-        var errbody = create(div);
+        var errbody = create("div");
         appendClass(errbody, "table");
         appendClass(errbody, "error");
-        settext(errbody, "Status: " + this.status + " Error: " + this.response);
+        settext(errbody, "Status: " + this.status + " Error: " + errorMessage(this));
         append2Parent(table, errbody);
       }
     },
@@ -0,0 +1,64 @@
+/*
+Copyright 2020 Kazım SARIKAYA
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package api
+
+import (
+	"github.com/kazimsarikaya/k8sinit/internal/k8sinit/audit"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const defaultAuditLimit = 100
+
+// AuditApiQuery returns audit entries newest first. since and until are
+// RFC 3339 times, identity, source and route filter exactly.
+func AuditApiQuery(w http.ResponseWriter, r *http.Request) {
+	l := audit.GetLogger()
+	if l == nil {
+		WriteError(w, ErrorNotReady, "audit log is not ready")
+		return
+	}
+	v := r.URL.Query()
+	q := audit.Query{
+		Identity: v.Get("identity"),
+		Source:   v.Get("source"),
+		Route:    v.Get("route"),
+		Limit:    defaultAuditLimit,
+	}
+	var err error
+	for name, t := range map[string]*time.Time{"since": &q.Since, "until": &q.Until} {
+		if s := v.Get(name); s != "" {
+			if *t, err = time.Parse(time.RFC3339, s); err != nil {
+				WriteError(w, ErrorBadRequest, "bad "+name+": "+err.Error())
+				return
+			}
+		}
+	}
+	if s := v.Get("limit"); s != "" {
+		if q.Limit, err = strconv.Atoi(s); err != nil || q.Limit < 0 {
+			WriteError(w, ErrorBadRequest, "bad limit")
+			return
+		}
+	}
+	entries, err := l.Query(q)
+	if err != nil {
+		WriteError(w, ErrorInternal, err.Error())
+		return
+	}
+	WriteData(w, http.StatusOK, entries)
+}
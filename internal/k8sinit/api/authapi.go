@@ -0,0 +1,149 @@
+/*
+Copyright 2020 Kazım SARIKAYA
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package api
+
+import (
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"github.com/kazimsarikaya/k8sinit/internal/k8sinit/audit"
+	"github.com/kazimsarikaya/k8sinit/internal/k8sinit/auth"
+	"github.com/pkg/errors"
+	klog "k8s.io/klog/v2"
+	"net/http"
+	"time"
+)
+
+type loginRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+type loginResponse struct {
+	Token    string    `json:"token"`
+	Username string    `json:"username"`
+	Expires  time.Time `json:"expires"`
+}
+
+type createTokenResponse struct {
+	Token  string     `json:"token"`
+	Detail auth.Token `json:"detail"`
+}
+
+// AuthApiLogin starts a session. The token is set as a cookie for the web ui
+// and returned for use as a bearer token.
+func AuthApiLogin(w http.ResponseWriter, r *http.Request) {
+	a := auth.GetAuthenticator()
+	if a == nil {
+		WriteError(w, ErrorNotReady, "authentication is not ready")
+		return
+	}
+	var req loginRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&req); err != nil {
+		WriteError(w, ErrorBadRequest, err.Error())
+		return
+	}
+	audit.SetIdentity(r.Context(), req.Username)
+	token, s, err := a.Login(req.Username, req.Password)
+	if err != nil {
+		klog.V(0).Infof("login of %v from %v failed", req.Username, r.RemoteAddr)
+		WriteError(w, ErrorUnauthorized, err.Error())
+		return
+	}
+	klog.V(0).Infof("%v logged in from %v", s.Username, r.RemoteAddr)
+	http.SetCookie(w, auth.SessionCookie(token, s.Expires))
+	WriteData(w, http.StatusOK, loginResponse{Token: token, Username: s.Username, Expires: s.Expires})
+}
+
+func AuthApiLogout(w http.ResponseWriter, r *http.Request) {
+	if a := auth.GetAuthenticator(); a != nil {
+		a.Logout(auth.RequestToken(r))
+	}
+	http.SetCookie(w, auth.SessionCookie("", time.Time{}))
+	WriteData(w, http.StatusOK, nil)
+}
+
+// AuthApiSession returns the session of the request.
+func AuthApiSession(w http.ResponseWriter, r *http.Request) {
+	a := auth.GetAuthenticator()
+	if a == nil {
+		WriteError(w, ErrorNotReady, "authentication is not ready")
+		return
+	}
+	s, err := a.Authenticate(auth.RequestToken(r))
+	if err != nil {
+		WriteError(w, ErrorUnauthorized, err.Error())
+		return
+	}
+	WriteData(w, http.StatusOK, s)
+}
+
+func AuthApiListTokens(w http.ResponseWriter, r *http.Request) {
+	a := auth.GetAuthenticator()
+	if a == nil {
+		WriteError(w, ErrorNotReady, "authentication is not ready")
+		return
+	}
+	WriteData(w, http.StatusOK, a.Tokens())
+}
+
+// AuthApiCreateToken creates a named token. The secret is only in this
+// response.
+func AuthApiCreateToken(w http.ResponseWriter, r *http.Request) {
+	a := auth.GetAuthenticator()
+	if a == nil {
+		WriteError(w, ErrorNotReady, "authentication is not ready")
+		return
+	}
+	var t auth.Token
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&t); err != nil {
+		WriteError(w, ErrorBadRequest, err.Error())
+		return
+	}
+	secret, t, err := a.CreateToken(t)
+	if err != nil {
+		switch errors.Cause(err) {
+		case auth.BadTokenError:
+			WriteError(w, ErrorBadRequest, err.Error())
+		case auth.TokenExistsError:
+			WriteError(w, ErrorConflict, err.Error())
+		default:
+			WriteError(w, ErrorInternal, err.Error())
+		}
+		return
+	}
+	klog.V(0).Infof("token %v created with scopes %v", t.Name, t.Scopes)
+	WriteData(w, http.StatusCreated, createTokenResponse{Token: secret, Detail: t})
+}
+
+func AuthApiRevokeToken(w http.ResponseWriter, r *http.Request) {
+	a := auth.GetAuthenticator()
+	if a == nil {
+		WriteError(w, ErrorNotReady, "authentication is not ready")
+		return
+	}
+	name := mux.Vars(r)["name"]
+	if err := a.RevokeToken(name); err != nil {
+		if err == auth.TokenNotFoundError {
+			WriteError(w, ErrorNotFound, err.Error())
+		} else {
+			WriteError(w, ErrorInternal, err.Error())
+		}
+		return
+	}
+	klog.V(0).Infof("token %v revoked", name)
+	WriteData(w, http.StatusOK, nil)
+}
@@ -0,0 +1,117 @@
+/*
+Copyright 2020 Kazım SARIKAYA
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package api
+
+import (
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"github.com/kazimsarikaya/k8sinit/internal/k8sinit/boot"
+	"net/http"
+)
+
+func getBootProfiles(w http.ResponseWriter) *boot.Profiles {
+	ps := boot.GetProfiles()
+	if ps == nil {
+		WriteError(w, ErrorNotReady, "boot profiles are not loaded")
+	}
+	return ps
+}
+
+func bootApiError(w http.ResponseWriter, err error) {
+	switch err.(type) {
+	case *boot.ProfileValidationError:
+		WriteError(w, ErrorBadRequest, err.Error())
+		return
+	}
+	switch err {
+	case boot.ProfileNotFoundError:
+		WriteError(w, ErrorNotFound, err.Error())
+	case boot.ProfileExistsError:
+		WriteError(w, ErrorConflict, err.Error())
+	default:
+		WriteError(w, ErrorInternal, err.Error())
+	}
+}
+
+func BootApiListProfiles(w http.ResponseWriter, r *http.Request) {
+	ps := getBootProfiles(w)
+	if ps == nil {
+		return
+	}
+	WriteData(w, http.StatusOK, ps.List())
+}
+
+func BootApiGetProfile(w http.ResponseWriter, r *http.Request) {
+	ps := getBootProfiles(w)
+	if ps == nil {
+		return
+	}
+	p, err := ps.Get(mux.Vars(r)["name"])
+	if err != nil {
+		bootApiError(w, err)
+		return
+	}
+	WriteData(w, http.StatusOK, p)
+}
+
+func BootApiAddProfile(w http.ResponseWriter, r *http.Request) {
+	ps := getBootProfiles(w)
+	if ps == nil {
+		return
+	}
+	var p boot.Profile
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+		WriteError(w, ErrorBadRequest, "cannot decode boot profile: "+err.Error())
+		return
+	}
+	p, err := ps.Add(p)
+	if err != nil {
+		bootApiError(w, err)
+		return
+	}
+	WriteData(w, http.StatusCreated, p)
+}
+
+func BootApiUpdateProfile(w http.ResponseWriter, r *http.Request) {
+	ps := getBootProfiles(w)
+	if ps == nil {
+		return
+	}
+	var p boot.Profile
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+		WriteError(w, ErrorBadRequest, "cannot decode boot profile: "+err.Error())
+		return
+	}
+	p, err := ps.Update(mux.Vars(r)["name"], p)
+	if err != nil {
+		bootApiError(w, err)
+		return
+	}
+	WriteData(w, http.StatusOK, p)
+}
+
+func BootApiDeleteProfile(w http.ResponseWriter, r *http.Request) {
+	ps := getBootProfiles(w)
+	if ps == nil {
+		return
+	}
+	if err := ps.Delete(mux.Vars(r)["name"]); err != nil {
+		bootApiError(w, err)
+		return
+	}
+	WriteData(w, http.StatusOK, nil)
+}
@@ -0,0 +1,207 @@
+/*
+Copyright 2020 Kazım SARIKAYA
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package api
+
+import (
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"github.com/kazimsarikaya/k8sinit/internal/k8sinit/network/dhcp"
+	"net/http"
+	"time"
+)
+
+type dhcpLease struct {
+	dhcp.Lease
+	Active bool `json:"active"`
+}
+
+type leaseToStaticHostRequest struct {
+	Hostname string `json:"hostname,omitempty"`
+}
+
+func getDhcpServer(w http.ResponseWriter) *dhcp.NonBlockingDhcpServer {
+	s := dhcp.GetNonBlockingDhcpServer()
+	if s == nil {
+		WriteError(w, ErrorNotReady, "dhcp server is not running")
+	}
+	return s
+}
+
+func dhcpApiError(w http.ResponseWriter, err error) {
+	switch err.(type) {
+	case *dhcp.StaticHostValidationError:
+		WriteError(w, ErrorBadRequest, err.Error())
+		return
+	}
+	switch err {
+	case dhcp.StaticHostNotFoundError, dhcp.LeaseNotFoundError:
+		WriteError(w, ErrorNotFound, err.Error())
+	case dhcp.StaticHostExistsError:
+		WriteError(w, ErrorConflict, err.Error())
+	default:
+		WriteError(w, ErrorInternal, err.Error())
+	}
+}
+
+func DhcpApiListStaticHosts(w http.ResponseWriter, r *http.Request) {
+	s := getDhcpServer(w)
+	if s == nil {
+		return
+	}
+	WriteData(w, http.StatusOK, s.StaticHosts().List())
+}
+
+func DhcpApiGetStaticHost(w http.ResponseWriter, r *http.Request) {
+	s := getDhcpServer(w)
+	if s == nil {
+		return
+	}
+	h, err := s.StaticHosts().Get(mux.Vars(r)["mac"])
+	if err != nil {
+		dhcpApiError(w, err)
+		return
+	}
+	WriteData(w, http.StatusOK, h)
+}
+
+func DhcpApiAddStaticHost(w http.ResponseWriter, r *http.Request) {
+	s := getDhcpServer(w)
+	if s == nil {
+		return
+	}
+	var h dhcp.StaticHost
+	if err := json.NewDecoder(r.Body).Decode(&h); err != nil {
+		WriteError(w, ErrorBadRequest, "cannot decode static host: "+err.Error())
+		return
+	}
+	h, err := s.StaticHosts().Add(h)
+	if err != nil {
+		dhcpApiError(w, err)
+		return
+	}
+	WriteData(w, http.StatusCreated, h)
+}
+
+func DhcpApiUpdateStaticHost(w http.ResponseWriter, r *http.Request) {
+	s := getDhcpServer(w)
+	if s == nil {
+		return
+	}
+	var h dhcp.StaticHost
+	if err := json.NewDecoder(r.Body).Decode(&h); err != nil {
+		WriteError(w, ErrorBadRequest, "cannot decode static host: "+err.Error())
+		return
+	}
+	h, err := s.StaticHosts().Update(mux.Vars(r)["mac"], h)
+	if err != nil {
+		dhcpApiError(w, err)
+		return
+	}
+	WriteData(w, http.StatusOK, h)
+}
+
+func DhcpApiDeleteStaticHost(w http.ResponseWriter, r *http.Request) {
+	s := getDhcpServer(w)
+	if s == nil {
+		return
+	}
+	if err := s.StaticHosts().Delete(mux.Vars(r)["mac"]); err != nil {
+		dhcpApiError(w, err)
+		return
+	}
+	WriteData(w, http.StatusOK, nil)
+}
+
+// DhcpApiListLeases lists all known leases. The state query parameter can be
+// active or expired to filter them.
+func DhcpApiListLeases(w http.ResponseWriter, r *http.Request) {
+	s := getDhcpServer(w)
+	if s == nil {
+		return
+	}
+	state := r.URL.Query().Get("state")
+	if state != "" && state != "active" && state != "expired" {
+		WriteError(w, ErrorBadRequest, "state should be active or expired")
+		return
+	}
+	now := time.Now()
+	leases := []dhcpLease{}
+	for _, l := range s.Leases().List() {
+		active := l.IsActive(now)
+		if (state == "active" && !active) || (state == "expired" && active) {
+			continue
+		}
+		leases = append(leases, dhcpLease{Lease: l, Active: active})
+	}
+	WriteData(w, http.StatusOK, leases)
+}
+
+func DhcpApiGetLease(w http.ResponseWriter, r *http.Request) {
+	s := getDhcpServer(w)
+	if s == nil {
+		return
+	}
+	l, err := s.Leases().Get(mux.Vars(r)["mac"])
+	if err != nil {
+		dhcpApiError(w, err)
+		return
+	}
+	WriteData(w, http.StatusOK, dhcpLease{Lease: l, Active: l.IsActive(time.Now())})
+}
+
+func DhcpApiRevokeLease(w http.ResponseWriter, r *http.Request) {
+	s := getDhcpServer(w)
+	if s == nil {
+		return
+	}
+	if err := s.Leases().Revoke(mux.Vars(r)["mac"]); err != nil {
+		dhcpApiError(w, err)
+		return
+	}
+	WriteData(w, http.StatusOK, nil)
+}
+
+// DhcpApiLeaseToStaticHost reserves the leased address for the client. An
+// optional json body with a hostname overrides the hostname of the lease.
+func DhcpApiLeaseToStaticHost(w http.ResponseWriter, r *http.Request) {
+	s := getDhcpServer(w)
+	if s == nil {
+		return
+	}
+	l, err := s.Leases().Get(mux.Vars(r)["mac"])
+	if err != nil {
+		dhcpApiError(w, err)
+		return
+	}
+	h := dhcp.StaticHost{MAC: l.MAC, IP: l.IP, Hostname: l.Hostname}
+	if r.ContentLength != 0 {
+		var body leaseToStaticHostRequest
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			WriteError(w, ErrorBadRequest, "cannot decode body: "+err.Error())
+			return
+		}
+		if body.Hostname != "" {
+			h.Hostname = body.Hostname
+		}
+	}
+	h, err = s.StaticHosts().Add(h)
+	if err != nil {
+		dhcpApiError(w, err)
+		return
+	}
+	WriteData(w, http.StatusCreated, h)
+}
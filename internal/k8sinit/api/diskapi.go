@@ -17,7 +17,6 @@ limitations under the License.
 package api
 
 import (
-	"encoding/json"
 	"github.com/gorilla/mux"
 	"github.com/kazimsarikaya/k8sinit/internal/k8sinit/system"
 	"net/http"
@@ -26,106 +25,101 @@ import (
 func DiskApiListBlockDevices(w http.ResponseWriter, r *http.Request) {
 	bds, err := system.ListDisks()
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		WriteError(w, ErrorInternal, err.Error())
 		return
 	}
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "data": bds})
+	WriteData(w, http.StatusOK, bds)
 }
 
 func DiskApiListZpools(w http.ResponseWriter, r *http.Request) {
 	zps, err := system.ListZpools()
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		WriteError(w, ErrorInternal, err.Error())
 		return
 	}
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "data": zps})
+	WriteData(w, http.StatusOK, zps)
 }
 
 func DiskApiGetZpool(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	pool, ok := vars["pool"]
 	if !ok || pool == "" {
-		http.Error(w, "no pool param", http.StatusBadRequest)
+		WriteError(w, ErrorBadRequest, "no pool param")
 		return
 	}
 	zps, err := system.ListZpools()
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		WriteError(w, ErrorInternal, err.Error())
 		return
 	}
 	for _, zp := range zps {
 		if zp.Name == pool {
-			w.Header().Set("Content-Type", "application/json")
-			json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "data": zp})
+			WriteData(w, http.StatusOK, zp)
 			return
 		}
 	}
-	http.Error(w, "pool not found", http.StatusNotFound)
+	WriteError(w, ErrorNotFound, "pool not found")
 }
 
 func DiskApiListDatasets(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	pool, ok := vars["pool"]
 	if !ok || pool == "" {
-		http.Error(w, "no pool param", http.StatusBadRequest)
+		WriteError(w, ErrorBadRequest, "no pool param")
 		return
 	}
 	zps, err := system.ListZpools()
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		WriteError(w, ErrorInternal, err.Error())
 		return
 	}
 	for _, zp := range zps {
 		if zp.Name == pool {
 			dses, err := zp.Datasets()
 			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
+				WriteError(w, ErrorInternal, err.Error())
 				return
 			}
-			w.Header().Set("Content-Type", "application/json")
-			json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "data": dses})
+			WriteData(w, http.StatusOK, dses)
 			return
 		}
 	}
-	http.Error(w, "pool not found", http.StatusNotFound)
+	WriteError(w, ErrorNotFound, "pool not found")
 }
 
 func DiskApiGetDataset(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	pool, ok := vars["pool"]
 	if !ok || pool == "" {
-		http.Error(w, "no pool param", http.StatusBadRequest)
+		WriteError(w, ErrorBadRequest, "no pool param")
 		return
 	}
 	dataset, ok := vars["dataset"]
 	if !ok || dataset == "" {
-		http.Error(w, "no dataset param", http.StatusBadRequest)
+		WriteError(w, ErrorBadRequest, "no dataset param")
 		return
 	}
 	zps, err := system.ListZpools()
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		WriteError(w, ErrorInternal, err.Error())
 		return
 	}
 	for _, zp := range zps {
 		if zp.Name == pool {
 			dses, err := zp.Datasets()
 			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
+				WriteError(w, ErrorInternal, err.Error())
 				return
 			}
 			for _, ds := range dses {
 				if ds.Name == dataset {
-					w.Header().Set("Content-Type", "application/json")
-					json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "data": ds})
+					WriteData(w, http.StatusOK, ds)
 					return
 				}
 			}
-			http.Error(w, "dataset not found", http.StatusNotFound)
+			WriteError(w, ErrorNotFound, "dataset not found")
 			return
 		}
 	}
-	http.Error(w, "pool not found", http.StatusNotFound)
+	WriteError(w, ErrorNotFound, "pool not found")
 }
@@ -17,41 +17,245 @@ limitations under the License.
 package api
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/kazimsarikaya/k8sinit/internal/k8sinit"
+	"github.com/kazimsarikaya/k8sinit/internal/k8sinit/boot"
 	"github.com/kazimsarikaya/k8sinit/internal/k8sinit/network"
+	"github.com/kazimsarikaya/k8sinit/internal/k8sinit/network/dhcp"
+	"github.com/kazimsarikaya/k8sinit/internal/k8sinit/network/ntp"
+	"github.com/kazimsarikaya/k8sinit/internal/k8sinit/network/tftp"
 	klog "k8s.io/klog/v2"
+	"net"
 	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
 )
 
 func NetworkApiInterfaceList(w http.ResponseWriter, r *http.Request) {
 	res, err := network.GetInterfacesWithMacs()
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		WriteError(w, ErrorInternal, err.Error())
 		return
 	}
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]interface{}{"status": true, "data": res})
+	WriteData(w, http.StatusOK, res)
 }
 
+func NetworkApiNtpStatus(w http.ResponseWriter, r *http.Request) {
+	s := ntp.GetNonBlockingNtpServer()
+	if s == nil {
+		WriteError(w, ErrorNotReady, "ntp server is not running")
+		return
+	}
+	WriteData(w, http.StatusOK, s.Status())
+}
+
+// bootBaseUrl is the url of the plain http boot server the client should use.
+// Scripts may be fetched over https too, which ipxe cannot follow.
+func bootBaseUrl(r *http.Request) string {
+	if s := dhcp.GetNonBlockingDhcpServer(); s != nil {
+		return s.HttpUrl("")
+	}
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.Trim(host, "[]")
+	return "http://" + net.JoinHostPort(host, strconv.Itoa(k8sinit.HttpPort))
+}
+
+// NetworkApiTftp renders the ipxe script of a client. iPXE first gets a
+// script without a mac which chains to the per client url.
 func NetworkApiTftp(w http.ResponseWriter, r *http.Request) {
+	mac := r.URL.Query().Get("mac")
+	if mac == "" {
+		fmt.Fprintf(w, `#!ipxe
+chain %s/api/network/tftp?mac=${netX/mac}&ip=${netX/ip}
+`, bootBaseUrl(r))
+		return
+	}
+	profiles := boot.GetProfiles()
+	if profiles == nil {
+		WriteError(w, ErrorNotReady, "boot profiles are not loaded")
+		return
+	}
+	ip := r.URL.Query().Get("ip")
+	if ip == "" {
+		ip, _, _ = net.SplitHostPort(r.RemoteAddr)
+	}
+	group := ""
+	if s := dhcp.GetNonBlockingDhcpServer(); s != nil {
+		if l, err := s.Leases().Get(mac); err == nil {
+			group = l.Scope
+		}
+	}
+	p := profiles.Resolve(mac, ip, group)
+	klog.V(0).Infof("client %v %v boots with profile %v", mac, ip, p.Name)
+	base := bootBaseUrl(r) + "/api/network/boot"
 	fmt.Fprintf(w, `#!ipxe
+echo booting profile %s...
 echo loading kernel...
-kernel http://%s/api/network/tftp/vmlinuz k8sinit.role=node k8sinit.pool=%s
+kernel %s k8sinit.role=%s %s
 echo loading initrd...
-initrd http://%s/api/network/tftp/initrd
+initrd %s
 boot
-`, r.Host, "zp_k8s", r.Host)
+`, p.Name, boot.BootFileUrl(base, p.Kernel), p.Role, p.Args, boot.BootFileUrl(base, p.Initrd))
+}
+
+// NetworkApiBootFile serves kernels and initrds from the boot dataset of the
+// pool.
+func NetworkApiBootFile(w http.ResponseWriter, r *http.Request) {
+	serveBootFile(w, r, mux.Vars(r)["file"])
+}
+
+func serveBootFile(w http.ResponseWriter, r *http.Request, file string) {
+	fs := boot.GetFileServer()
+	if fs == nil {
+		WriteError(w, ErrorNotReady, "boot file server is not running")
+		return
+	}
+	bootFileError(w, fs.ServeBootFile(w, r, file))
+}
+
+// bootFileError writes the response of an error of the boot file server, the
+// transfer has not started then.
+func bootFileError(w http.ResponseWriter, err error) {
+	if err == nil {
+		return
+	}
+	switch err {
+	case boot.BadFileNameError:
+		WriteError(w, ErrorBadRequest, err.Error())
+	case boot.FileNotFoundError:
+		WriteError(w, ErrorNotFound, err.Error())
+	case k8sinit.K8SInitNotInstalledError:
+		WriteError(w, ErrorNotReady, err.Error())
+	case boot.QueueFullError:
+		w.Header().Set("Retry-After", "5")
+		WriteError(w, ErrorTooManyRequests, err.Error())
+	case context.Canceled, context.DeadlineExceeded:
+		// the client is gone
+	default:
+		WriteError(w, ErrorInternal, err.Error())
+	}
+}
+
+// NetworkApiIpxeBinary serves the ipxe binaries of the tftp server over http
+// for uefi http boot clients.
+func NetworkApiIpxeBinary(w http.ResponseWriter, r *http.Request) {
+	file := mux.Vars(r)["file"]
+	s := tftp.GetNonBlockingTftpServer()
+	if s == nil {
+		WriteError(w, ErrorNotReady, "tftp server is not running")
+		return
+	}
+	path, ok := s.File(file)
+	if !ok {
+		WriteError(w, ErrorNotFound, "file not found")
+		return
+	}
+	fs := boot.GetFileServer()
+	if fs == nil {
+		WriteError(w, ErrorNotReady, "boot file server is not running")
+		return
+	}
+	w.Header().Set("Content-Type", ipxeContentType(file))
+	bootFileError(w, fs.ServeFile(w, r, path))
+}
+
+// ipxeContentType is application/efi for efi binaries, bios binaries have no
+// registered type.
+func ipxeContentType(file string) string {
+	if strings.EqualFold(filepath.Ext(file), ".efi") {
+		return "application/efi"
+	}
+	return ContentBinary
+}
+
+func NetworkApiListIpxeBinaries(w http.ResponseWriter, r *http.Request) {
+	s := tftp.GetNonBlockingTftpServer()
+	if s == nil {
+		WriteError(w, ErrorNotReady, "tftp server is not running")
+		return
+	}
+	WriteData(w, http.StatusOK, s.IpxeBinaries())
+}
+
+// NetworkApiUploadIpxeBinary replaces an ipxe binary with the request body.
+// The replacement is kept in the boot dataset of the pool.
+func NetworkApiUploadIpxeBinary(w http.ResponseWriter, r *http.Request) {
+	s := tftp.GetNonBlockingTftpServer()
+	if s == nil {
+		WriteError(w, ErrorNotReady, "tftp server is not running")
+		return
+	}
+	// one byte over the limit lets InstallIpxeBinary tell a body that is too
+	// large, the rest of it is not read
+	body := http.MaxBytesReader(w, r.Body, tftp.MaxIpxeBinarySize+1)
+	b, err := s.InstallIpxeBinary(mux.Vars(r)["file"], body)
+	if err != nil {
+		switch err {
+		case tftp.UnknownIpxeBinaryError:
+			WriteError(w, ErrorNotFound, err.Error())
+		case tftp.IpxeBinaryTooLargeError:
+			WriteError(w, ErrorBadRequest, fmt.Sprintf("%v, the limit is %v bytes", err, tftp.MaxIpxeBinarySize))
+		case k8sinit.K8SInitNotInstalledError:
+			WriteError(w, ErrorNotReady, err.Error())
+		default:
+			WriteError(w, ErrorInternal, err.Error())
+		}
+		return
+	}
+	WriteData(w, http.StatusOK, b)
+}
+
+// NetworkApiListTftpUploads lists the files tftp clients uploaded.
+func NetworkApiListTftpUploads(w http.ResponseWriter, r *http.Request) {
+	s := tftp.GetNonBlockingTftpServer()
+	if s == nil {
+		WriteError(w, ErrorNotReady, "tftp server is not running")
+		return
+	}
+	uploads, err := s.Uploads()
+	if err != nil {
+		WriteError(w, ErrorInternal, err.Error())
+		return
+	}
+	WriteData(w, http.StatusOK, uploads)
+}
+
+func NetworkApiTftpUpload(w http.ResponseWriter, r *http.Request) {
+	s := tftp.GetNonBlockingTftpServer()
+	if s == nil {
+		WriteError(w, ErrorNotReady, "tftp server is not running")
+		return
+	}
+	vars := mux.Vars(r)
+	path, err := s.UploadFile(vars["client"], vars["file"])
+	if err != nil {
+		WriteError(w, ErrorNotFound, "file not found")
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	http.ServeFile(w, r, path)
 }
 
 func NetworkApiTftpVmlinuz(w http.ResponseWriter, r *http.Request) {
-	klog.V(0).Infof("start sending vmlinuz")
-	http.ServeFile(w, r, "/zp_k8s/boot/vmlinuz") // TODO: get base path from config
-	klog.V(0).Infof("sending vmlinuz ended")
+	serveBootFile(w, r, "vmlinuz")
 }
 
 func NetworkApiTftpInitrd(w http.ResponseWriter, r *http.Request) {
-	klog.V(0).Infof("start sending initramfs")
-	http.ServeFile(w, r, "/zp_k8s/boot/initramfs") // TODO: get base path from config
-	klog.V(0).Infof("sending initramfs ended")
+	serveBootFile(w, r, "initramfs")
+}
+
+// NetworkApiBootTransfers returns the counters of boot file transfers.
+func NetworkApiBootTransfers(w http.ResponseWriter, r *http.Request) {
+	fs := boot.GetFileServer()
+	if fs == nil {
+		WriteError(w, ErrorNotReady, "boot file server is not running")
+		return
+	}
+	WriteData(w, http.StatusOK, fs.Stats())
 }
@@ -0,0 +1,298 @@
+/*
+Copyright 2020 Kazım SARIKAYA
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package api
+
+import (
+	"encoding"
+	"encoding/json"
+	"github.com/kazimsarikaya/k8sinit/internal/k8sinit/auth"
+	"net/http"
+	"path"
+	"reflect"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	pathParamRegexp = regexp.MustCompile(`\{([^}:]+)(?::([^}]+))?\}`)
+
+	timeType          = reflect.TypeOf(time.Time{})
+	textMarshalerType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+
+	openApiOnce sync.Once
+	openApiDoc  []byte
+)
+
+type object = map[string]interface{}
+
+// schemas builds json schemas of go types as encoding/json marshals them.
+// Named structs become components referenced by name.
+type schemas struct {
+	components object
+}
+
+func schemaName(t reflect.Type) string {
+	return path.Base(t.PkgPath()) + "." + t.Name()
+}
+
+func (s *schemas) of(t reflect.Type) object {
+	if t.Kind() == reflect.Ptr {
+		return s.of(t.Elem())
+	}
+	if t == timeType {
+		return object{"type": "string", "format": "date-time"}
+	}
+	if t.Implements(textMarshalerType) || reflect.PtrTo(t).Implements(textMarshalerType) {
+		return object{"type": "string"}
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return object{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return object{"type": "integer"}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return object{"type": "integer", "minimum": 0}
+	case reflect.Float32, reflect.Float64:
+		return object{"type": "number"}
+	case reflect.String:
+		return object{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return object{"type": "string", "format": "byte"}
+		}
+		return object{"type": "array", "items": s.of(t.Elem())}
+	case reflect.Map:
+		return object{"type": "object", "additionalProperties": s.of(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return s.structOf(t)
+		}
+		name := schemaName(t)
+		if _, ok := s.components[name]; !ok {
+			// recursive types find the name while their schema is built
+			s.components[name] = object{}
+			s.components[name] = s.structOf(t)
+		}
+		return object{"$ref": "#/components/schemas/" + name}
+	}
+	return object{}
+}
+
+func (s *schemas) structOf(t reflect.Type) object {
+	properties := object{}
+	required := []string{}
+	s.addFields(t, properties, &required)
+	result := object{"type": "object", "properties": properties}
+	if len(required) > 0 {
+		result["required"] = required
+	}
+	return result
+}
+
+func (s *schemas) addFields(t reflect.Type, properties object, required *[]string) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		opts := strings.Split(tag, ",")
+		name := opts[0]
+		ft := f.Type
+		if f.Anonymous && name == "" {
+			if ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				s.addFields(ft, properties, required)
+				continue
+			}
+		}
+		if f.PkgPath != "" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		schema := s.of(ft)
+		omitempty := false
+		for _, o := range opts[1:] {
+			switch o {
+			case "omitempty":
+				omitempty = true
+			case "string":
+				schema = object{"type": "string"}
+			}
+		}
+		properties[name] = schema
+		if !omitempty {
+			*required = append(*required, name)
+		}
+	}
+}
+
+func jsonContent(schema object) object {
+	return object{"application/json": object{"schema": schema}}
+}
+
+func binaryContent(contentType string) object {
+	return object{contentType: object{"schema": object{"type": "string", "format": "binary"}}}
+}
+
+func (s *schemas) operation(rt Route) object {
+	op := object{
+		"summary":     rt.Summary,
+		"operationId": handlerName(rt.Handler),
+		"x-scope":     string(rt.Scope),
+	}
+	if rt.Scope == auth.ScopeNone {
+		op["security"] = []object{}
+	} else {
+		op["security"] = []object{{"bearer": []string{}}, {"session": []string{}}}
+	}
+
+	params := []object{}
+	for _, m := range pathParamRegexp.FindAllStringSubmatch(rt.Path, -1) {
+		schema := object{"type": "string"}
+		if m[2] != "" && m[2] != ".*" {
+			schema["pattern"] = m[2]
+		}
+		params = append(params, object{"name": m[1], "in": "path", "required": true, "schema": schema})
+	}
+	for _, q := range rt.Query {
+		params = append(params, object{"name": q, "in": "query", "schema": object{"type": "string"}})
+	}
+	if len(params) > 0 {
+		op["parameters"] = params
+	}
+
+	if rt.Request != nil && !rt.Websocket {
+		op["requestBody"] = object{"required": true, "content": jsonContent(s.of(reflect.TypeOf(rt.Request)))}
+	} else if rt.RequestContent != "" {
+		op["requestBody"] = object{"required": true, "content": binaryContent(rt.RequestContent)}
+	}
+
+	responses := object{
+		"default": object{
+			"description": "error",
+			"content":     jsonContent(object{"$ref": "#/components/schemas/ErrorResponse"}),
+		},
+	}
+	status := "200"
+	if rt.Status != 0 {
+		status = strconv.Itoa(rt.Status)
+	}
+	switch {
+	case rt.Websocket:
+		description := "websocket session"
+		if rt.Request != nil {
+			s.of(reflect.TypeOf(rt.Request))
+			description += ", the first message is a " + schemaName(reflect.TypeOf(rt.Request))
+		}
+		responses["101"] = object{"description": description}
+	case rt.Content != "":
+		responses[status] = object{"description": "ok", "content": binaryContent(rt.Content)}
+	default:
+		envelope := object{
+			"type":       "object",
+			"properties": object{"success": object{"type": "boolean"}},
+			"required":   []string{"success"},
+		}
+		if rt.Response != nil {
+			envelope["properties"].(object)["data"] = s.of(reflect.TypeOf(rt.Response))
+			envelope["required"] = []string{"success", "data"}
+		}
+		responses[status] = object{"description": "ok", "content": jsonContent(envelope)}
+	}
+	op["responses"] = responses
+	return op
+}
+
+// handlerName returns the name of the handler of a route for operation ids.
+func handlerName(f http.HandlerFunc) string {
+	name := runtime.FuncForPC(reflect.ValueOf(f).Pointer()).Name()
+	return name[strings.LastIndex(name, ".")+1:]
+}
+
+// OpenApi builds the openapi document of routes.
+func OpenApi(routes []Route) object {
+	s := &schemas{components: object{}}
+	s.components["Error"] = object{
+		"type": "object",
+		"properties": object{
+			"code":    object{"type": "string", "enum": errorCodes()},
+			"message": object{"type": "string"},
+		},
+		"required": []string{"code", "message"},
+	}
+	s.components["ErrorResponse"] = object{
+		"type": "object",
+		"properties": object{
+			"success": object{"type": "boolean"},
+			"error":   object{"$ref": "#/components/schemas/Error"},
+		},
+		"required": []string{"success", "error"},
+	}
+	paths := object{}
+	for _, rt := range routes {
+		p := pathParamRegexp.ReplaceAllString(rt.Path, "{$1}")
+		item, ok := paths[p].(object)
+		if !ok {
+			item = object{}
+			paths[p] = item
+		}
+		item[strings.ToLower(rt.Method)] = s.operation(rt)
+	}
+	return object{
+		"openapi": "3.0.3",
+		"info": object{
+			"title":   "k8sinit management api",
+			"version": "1",
+		},
+		"paths": paths,
+		"components": object{
+			"schemas": s.components,
+			"securitySchemes": object{
+				"bearer":  object{"type": "http", "scheme": "bearer"},
+				"session": object{"type": "apiKey", "in": "cookie", "name": auth.SessionCookieName},
+			},
+		},
+	}
+}
+
+func errorCodes() []string {
+	result := make([]string, 0, len(errorStatuses))
+	for code := range errorStatuses {
+		result = append(result, string(code))
+	}
+	sort.Strings(result)
+	return result
+}
+
+// SystemApiOpenApi serves the openapi document of the api.
+func SystemApiOpenApi(w http.ResponseWriter, r *http.Request) {
+	openApiOnce.Do(func() {
+		openApiDoc, _ = json.MarshalIndent(OpenApi(Routes()), "", "  ")
+	})
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(openApiDoc)
+}
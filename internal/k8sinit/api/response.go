@@ -0,0 +1,101 @@
+/*
+Copyright 2020 Kazım SARIKAYA
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// ErrorCode tells api clients the kind of an error without parsing its
+// message.
+type ErrorCode string
+
+const (
+	ErrorBadRequest       ErrorCode = "bad_request"
+	ErrorUnauthorized     ErrorCode = "unauthorized"
+	ErrorForbidden        ErrorCode = "forbidden"
+	ErrorNotFound         ErrorCode = "not_found"
+	ErrorMethodNotAllowed ErrorCode = "method_not_allowed"
+	ErrorConflict         ErrorCode = "conflict"
+	ErrorTooManyRequests  ErrorCode = "too_many_requests"
+	ErrorInternal         ErrorCode = "internal"
+	ErrorNotReady         ErrorCode = "not_ready"
+)
+
+var errorStatuses = map[ErrorCode]int{
+	ErrorBadRequest:       http.StatusBadRequest,
+	ErrorUnauthorized:     http.StatusUnauthorized,
+	ErrorForbidden:        http.StatusForbidden,
+	ErrorNotFound:         http.StatusNotFound,
+	ErrorMethodNotAllowed: http.StatusMethodNotAllowed,
+	ErrorConflict:         http.StatusConflict,
+	ErrorTooManyRequests:  http.StatusTooManyRequests,
+	ErrorInternal:         http.StatusInternalServerError,
+	ErrorNotReady:         http.StatusServiceUnavailable,
+}
+
+// Status returns the http status of responses with code.
+func (c ErrorCode) Status() int {
+	if status, ok := errorStatuses[c]; ok {
+		return status
+	}
+	return http.StatusInternalServerError
+}
+
+// ErrorCodeOf returns the code of an error response with status.
+func ErrorCodeOf(status int) ErrorCode {
+	for code, s := range errorStatuses {
+		if s == status {
+			return code
+		}
+	}
+	if status >= 500 {
+		return ErrorInternal
+	}
+	return ErrorBadRequest
+}
+
+type Error struct {
+	Code    ErrorCode `json:"code"`
+	Message string    `json:"message"`
+}
+
+// Response is the envelope of every json response of the api. Data is set
+// on success, Error otherwise.
+type Response struct {
+	Success bool        `json:"success"`
+	Data    interface{} `json:"data,omitempty"`
+	Error   *Error      `json:"error,omitempty"`
+}
+
+func writeResponse(w http.ResponseWriter, status int, resp *Response) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// WriteData sends data in a successful response, nil data is left out.
+func WriteData(w http.ResponseWriter, status int, data interface{}) {
+	writeResponse(w, status, &Response{Success: true, Data: data})
+}
+
+// WriteError sends an error response with the status of code.
+func WriteError(w http.ResponseWriter, code ErrorCode, message string) {
+	writeResponse(w, code.Status(), &Response{Error: &Error{Code: code, Message: message}})
+}
@@ -0,0 +1,181 @@
+/*
+Copyright 2020 Kazım SARIKAYA
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package api
+
+import (
+	"github.com/kazimsarikaya/k8sinit/internal/k8sinit"
+	"github.com/kazimsarikaya/k8sinit/internal/k8sinit/audit"
+	"github.com/kazimsarikaya/k8sinit/internal/k8sinit/auth"
+	"github.com/kazimsarikaya/k8sinit/internal/k8sinit/boot"
+	"github.com/kazimsarikaya/k8sinit/internal/k8sinit/network/dhcp"
+	"github.com/kazimsarikaya/k8sinit/internal/k8sinit/network/ntp"
+	"github.com/kazimsarikaya/k8sinit/internal/k8sinit/network/tftp"
+	"github.com/kazimsarikaya/k8sinit/internal/k8sinit/pki"
+	"github.com/kazimsarikaya/k8sinit/internal/k8sinit/system"
+	"github.com/mistifyio/go-zfs"
+	"net/http"
+)
+
+const (
+	ContentPem    = "application/x-pem-file"
+	ContentBinary = "application/octet-stream"
+	ContentText   = "text/plain"
+)
+
+// Route is an endpoint of the api. Request and Response are samples of the
+// json body and the response data which describe the route in the openapi
+// document, Status is the status of successful responses when not 200.
+// Content is the content type of routes not answering json and
+// RequestContent of the ones not taking json. Boot routes are served on the
+// plain http boot listener too.
+type Route struct {
+	Method         string
+	Path           string
+	Scope          auth.Scope
+	Handler        http.HandlerFunc
+	Summary        string
+	Query          []string
+	Request        interface{}
+	RequestContent string
+	Response       interface{}
+	Content        string
+	Status         int
+	Websocket      bool
+	Boot           bool
+}
+
+type healthStatus struct {
+	OK bool `json:"ok"`
+}
+
+func SystemApiHealth(w http.ResponseWriter, r *http.Request) {
+	WriteData(w, http.StatusOK, healthStatus{OK: true})
+}
+
+// Routes returns the routes of the api.
+func Routes() []Route {
+	get, post, put, del := http.MethodGet, http.MethodPost, http.MethodPut, http.MethodDelete
+	none, bootScope, read, write, admin := auth.ScopeNone, auth.ScopeBoot, auth.ScopeRead, auth.ScopeWrite, auth.ScopeAdmin
+	return []Route{
+		{Method: get, Path: "/api/health", Scope: none, Handler: SystemApiHealth, Boot: true,
+			Summary: "Health of the management server", Response: healthStatus{}},
+		{Method: get, Path: "/api/network/tftp", Scope: bootScope, Handler: NetworkApiTftp, Boot: true,
+			Summary: "iPXE script of a client", Query: []string{"mac", "ip"}, Content: ContentText},
+		{Method: get, Path: "/api/network/tftp/vmlinuz", Scope: bootScope, Handler: NetworkApiTftpVmlinuz, Boot: true,
+			Summary: "Default kernel", Content: ContentBinary},
+		{Method: get, Path: "/api/network/tftp/initrd", Scope: bootScope, Handler: NetworkApiTftpInitrd, Boot: true,
+			Summary: "Default initrd", Content: ContentBinary},
+		{Method: get, Path: "/api/network/ipxe/{file}", Scope: bootScope, Handler: NetworkApiIpxeBinary, Boot: true,
+			Summary: "iPXE binary for http boot clients", Content: ContentBinary},
+		{Method: get, Path: "/api/network/boot/{file}", Scope: bootScope, Handler: NetworkApiBootFile, Boot: true,
+			Summary: "Kernel or initrd from the boot dataset", Content: ContentBinary},
+
+		{Method: get, Path: "/api/openapi.json", Scope: none, Handler: SystemApiOpenApi,
+			Summary: "OpenAPI document of the api", Content: "application/json"},
+		{Method: post, Path: "/api/auth/login", Scope: none, Handler: AuthApiLogin,
+			Summary: "Start a session", Request: loginRequest{}, Response: loginResponse{}},
+		{Method: post, Path: "/api/auth/logout", Scope: none, Handler: AuthApiLogout,
+			Summary: "End the session"},
+		{Method: get, Path: "/api/auth/session", Scope: bootScope, Handler: AuthApiSession,
+			Summary: "Session of the request", Response: auth.Session{}},
+		{Method: get, Path: "/api/auth/tokens", Scope: admin, Handler: AuthApiListTokens,
+			Summary: "List named tokens", Response: []auth.Token{}},
+		{Method: post, Path: "/api/auth/tokens", Scope: admin, Handler: AuthApiCreateToken,
+			Summary: "Create a named token", Request: auth.Token{}, Response: createTokenResponse{}, Status: http.StatusCreated},
+		{Method: del, Path: "/api/auth/tokens/{name}", Scope: admin, Handler: AuthApiRevokeToken,
+			Summary: "Revoke a named token"},
+		{Method: get, Path: "/api/audit", Scope: admin, Handler: AuditApiQuery,
+			Summary: "Query the audit log", Query: []string{"since", "until", "identity", "source", "route", "limit"},
+			Response: []audit.Entry{}},
+
+		{Method: get, Path: "/api/disks", Scope: read, Handler: DiskApiListBlockDevices,
+			Summary: "List block devices", Response: []system.BlockDevice{}},
+		{Method: get, Path: "/api/zpools", Scope: read, Handler: DiskApiListZpools,
+			Summary: "List zfs pools", Response: []zfs.Zpool{}},
+		{Method: get, Path: "/api/zpools/{pool}", Scope: read, Handler: DiskApiGetZpool,
+			Summary: "Get a zfs pool", Response: zfs.Zpool{}},
+		{Method: get, Path: "/api/zpools/{pool}/datasets", Scope: read, Handler: DiskApiListDatasets,
+			Summary: "List datasets of a zfs pool", Response: []zfs.Dataset{}},
+		{Method: get, Path: "/api/zpools/{pool}/datasets/{dataset:.*}", Scope: read, Handler: DiskApiGetDataset,
+			Summary: "Get a dataset of a zfs pool", Response: zfs.Dataset{}},
+
+		{Method: post, Path: "/api/system/reboot", Scope: admin, Handler: SystemApiReboot,
+			Summary: "Reboot in 15 seconds", Response: ""},
+		{Method: post, Path: "/api/system/poweroff", Scope: admin, Handler: SystemApiPoweroff,
+			Summary: "Power off in 15 seconds", Response: ""},
+		{Method: get, Path: "/api/system/time", Scope: read, Handler: SystemApiTimeStatus,
+			Summary: "Time sync status", Response: system.TimeSyncStatus{}},
+		{Method: get, Path: "/api/system/install", Scope: admin, Handler: SystemApiInstall, Websocket: true,
+			Summary: "Install the system, the install config is the first message and the output is streamed back",
+			Request: k8sinit.InstallConfig{}},
+		{Method: get, Path: "/api/system/tls", Scope: read, Handler: SystemApiTlsInfo,
+			Summary: "Certificates of the management server", Response: tlsInfo{}},
+		{Method: get, Path: "/api/system/tls/ca.crt", Scope: none, Handler: SystemApiTlsCACertificate,
+			Summary: "On-box CA certificate", Content: ContentPem},
+		{Method: post, Path: "/api/system/tls/rotate", Scope: admin, Handler: SystemApiTlsRotate,
+			Summary: "Issue a new server certificate", Response: pki.CertificateInfo{}},
+		{Method: put, Path: "/api/system/tls/certificate", Scope: admin, Handler: SystemApiTlsReplace,
+			Summary: "Replace the server certificate with a pem bundle", RequestContent: ContentPem,
+			Response: pki.CertificateInfo{}},
+
+		{Method: get, Path: "/api/network/interfaces", Scope: read, Handler: NetworkApiInterfaceList,
+			Summary: "Network interfaces and their macs", Response: map[string]string{}},
+		{Method: get, Path: "/api/network/ntp", Scope: read, Handler: NetworkApiNtpStatus,
+			Summary: "NTP server status", Response: ntp.Status{}},
+		{Method: get, Path: "/api/network/tftp/uploads", Scope: read, Handler: NetworkApiListTftpUploads,
+			Summary: "List files uploaded by tftp clients", Response: []tftp.Upload{}},
+		{Method: get, Path: "/api/network/tftp/uploads/{client}/{file}", Scope: read, Handler: NetworkApiTftpUpload,
+			Summary: "File uploaded by a tftp client", Content: ContentBinary},
+		{Method: get, Path: "/api/network/ipxe", Scope: read, Handler: NetworkApiListIpxeBinaries,
+			Summary: "List iPXE binaries", Response: []tftp.IpxeBinary{}},
+		{Method: put, Path: "/api/network/ipxe/{file}", Scope: write, Handler: NetworkApiUploadIpxeBinary,
+			Summary: "Replace an iPXE binary", RequestContent: ContentBinary, Response: tftp.IpxeBinary{}},
+		{Method: get, Path: "/api/network/transfers", Scope: read, Handler: NetworkApiBootTransfers,
+			Summary: "Boot file transfer counters", Response: boot.TransferStats{}},
+
+		{Method: get, Path: "/api/boot/profiles", Scope: read, Handler: BootApiListProfiles,
+			Summary: "List boot profiles", Response: []boot.Profile{}},
+		{Method: post, Path: "/api/boot/profiles", Scope: write, Handler: BootApiAddProfile,
+			Summary: "Add a boot profile", Request: boot.Profile{}, Response: boot.Profile{}, Status: http.StatusCreated},
+		{Method: get, Path: "/api/boot/profiles/{name}", Scope: read, Handler: BootApiGetProfile,
+			Summary: "Get a boot profile", Response: boot.Profile{}},
+		{Method: put, Path: "/api/boot/profiles/{name}", Scope: write, Handler: BootApiUpdateProfile,
+			Summary: "Update a boot profile", Request: boot.Profile{}, Response: boot.Profile{}},
+		{Method: del, Path: "/api/boot/profiles/{name}", Scope: write, Handler: BootApiDeleteProfile,
+			Summary: "Delete a boot profile"},
+
+		{Method: get, Path: "/api/dhcp/static", Scope: read, Handler: DhcpApiListStaticHosts,
+			Summary: "List static hosts", Response: []dhcp.StaticHost{}},
+		{Method: post, Path: "/api/dhcp/static", Scope: write, Handler: DhcpApiAddStaticHost,
+			Summary: "Add a static host", Request: dhcp.StaticHost{}, Response: dhcp.StaticHost{}, Status: http.StatusCreated},
+		{Method: get, Path: "/api/dhcp/static/{mac}", Scope: read, Handler: DhcpApiGetStaticHost,
+			Summary: "Get a static host", Response: dhcp.StaticHost{}},
+		{Method: put, Path: "/api/dhcp/static/{mac}", Scope: write, Handler: DhcpApiUpdateStaticHost,
+			Summary: "Update a static host", Request: dhcp.StaticHost{}, Response: dhcp.StaticHost{}},
+		{Method: del, Path: "/api/dhcp/static/{mac}", Scope: write, Handler: DhcpApiDeleteStaticHost,
+			Summary: "Delete a static host"},
+		{Method: get, Path: "/api/dhcp/leases", Scope: read, Handler: DhcpApiListLeases,
+			Summary: "List leases, state is active or expired", Query: []string{"state"}, Response: []dhcpLease{}},
+		{Method: get, Path: "/api/dhcp/leases/{mac}", Scope: read, Handler: DhcpApiGetLease,
+			Summary: "Get a lease", Response: dhcpLease{}},
+		{Method: del, Path: "/api/dhcp/leases/{mac}", Scope: write, Handler: DhcpApiRevokeLease,
+			Summary: "Revoke a lease"},
+		{Method: post, Path: "/api/dhcp/leases/{mac}/static", Scope: write, Handler: DhcpApiLeaseToStaticHost,
+			Summary: "Reserve the leased address as a static host", Request: leaseToStaticHostRequest{},
+			Response: dhcp.StaticHost{}, Status: http.StatusCreated},
+	}
+}
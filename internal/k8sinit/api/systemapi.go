@@ -22,8 +22,12 @@ import (
 	"fmt"
 	"github.com/gorilla/websocket"
 	"github.com/kazimsarikaya/k8sinit/internal/k8sinit"
+	"github.com/kazimsarikaya/k8sinit/internal/k8sinit/audit"
+	"github.com/kazimsarikaya/k8sinit/internal/k8sinit/pki"
 	"github.com/kazimsarikaya/k8sinit/internal/k8sinit/system"
+	"github.com/pkg/errors"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"time"
 )
@@ -33,8 +37,7 @@ func SystemApiReboot(w http.ResponseWriter, r *http.Request) {
 		time.Sleep(time.Second * 15)
 		system.Reboot()
 	}()
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]interface{}{"status": true, "data": "system will be rebooted in 15 seconds"})
+	WriteData(w, http.StatusOK, "system will be rebooted in 15 seconds")
 }
 
 func SystemApiPoweroff(w http.ResponseWriter, r *http.Request) {
@@ -42,19 +45,28 @@ func SystemApiPoweroff(w http.ResponseWriter, r *http.Request) {
 		time.Sleep(time.Second * 15)
 		system.Poweroff()
 	}()
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]interface{}{"ok": true, "data": "system will be poweroffed in 15 seconds"})
+	WriteData(w, http.StatusOK, "system will be poweroffed in 15 seconds")
+}
+
+func SystemApiTimeStatus(w http.ResponseWriter, r *http.Request) {
+	ts := system.GetTimeSync()
+	if ts == nil {
+		WriteError(w, ErrorNotReady, "time sync is not running")
+		return
+	}
+	WriteData(w, http.StatusOK, ts.Status())
 }
 
 func SystemApiInstall(w http.ResponseWriter, r *http.Request) {
 	var upgrader = websocket.Upgrader{
 		ReadBufferSize:  1024,
 		WriteBufferSize: 1024,
+		Error: func(w http.ResponseWriter, r *http.Request, status int, reason error) {
+			WriteError(w, ErrorCodeOf(status), reason.Error())
+		},
 	}
-	upgrader.CheckOrigin = func(r *http.Request) bool { return true }
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 	messageType, sr, err := conn.NextReader()
@@ -71,6 +83,7 @@ func SystemApiInstall(w http.ResponseWriter, r *http.Request) {
 	if len(ic.PoolName) == 0 {
 		ic.PoolName = "zp_k8s"
 	}
+	audit.AddParam(r.Context(), "config", ic)
 	pr, pw := io.Pipe()
 	var stop bool = false
 	go func() {
@@ -93,3 +106,70 @@ func SystemApiInstall(w http.ResponseWriter, r *http.Request) {
 	conn.Close()
 	stop = true
 }
+
+type tlsInfo struct {
+	CA     pki.CertificateInfo `json:"ca"`
+	Server pki.CertificateInfo `json:"server"`
+}
+
+func SystemApiTlsInfo(w http.ResponseWriter, r *http.Request) {
+	p := pki.GetPki()
+	if p == nil {
+		WriteError(w, ErrorNotReady, pki.PkiNotReadyError.Error())
+		return
+	}
+	WriteData(w, http.StatusOK, tlsInfo{CA: p.CACertificateInfo(), Server: p.ServerCertificateInfo()})
+}
+
+// SystemApiTlsCACertificate serves the ca certificate for the browsers and
+// tools talking to the management api.
+func SystemApiTlsCACertificate(w http.ResponseWriter, r *http.Request) {
+	p := pki.GetPki()
+	if p == nil {
+		WriteError(w, ErrorNotReady, pki.PkiNotReadyError.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-pem-file")
+	w.Header().Set("Content-Disposition", "attachment; filename=\""+pki.CACertFilename+"\"")
+	w.Write(p.CACertificate())
+}
+
+// SystemApiTlsRotate issues a new server certificate from the on-box ca.
+func SystemApiTlsRotate(w http.ResponseWriter, r *http.Request) {
+	p := pki.GetPki()
+	if p == nil {
+		WriteError(w, ErrorNotReady, pki.PkiNotReadyError.Error())
+		return
+	}
+	info, err := p.RotateServerCertificate()
+	if err != nil {
+		WriteError(w, ErrorInternal, err.Error())
+		return
+	}
+	WriteData(w, http.StatusOK, info)
+}
+
+// SystemApiTlsReplace replaces the server certificate with the pem bundle of
+// a certificate chain and its key in the request body.
+func SystemApiTlsReplace(w http.ResponseWriter, r *http.Request) {
+	p := pki.GetPki()
+	if p == nil {
+		WriteError(w, ErrorNotReady, pki.PkiNotReadyError.Error())
+		return
+	}
+	data, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 1<<20))
+	if err != nil {
+		WriteError(w, ErrorBadRequest, err.Error())
+		return
+	}
+	info, err := p.ReplaceServerCertificate(data)
+	if err != nil {
+		if errors.Cause(err) == pki.InvalidCertificateError {
+			WriteError(w, ErrorBadRequest, err.Error())
+		} else {
+			WriteError(w, ErrorInternal, err.Error())
+		}
+		return
+	}
+	WriteData(w, http.StatusOK, info)
+}
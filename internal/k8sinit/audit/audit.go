@@ -0,0 +1,287 @@
+/*
+Copyright 2020 Kazım SARIKAYA
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package audit
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	klog "k8s.io/klog/v2"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+)
+
+const (
+	LogFilename = "audit.log"
+
+	// RuntimeDir keeps the audit log until the system is installed
+	RuntimeDir = "/run/k8sinit/audit"
+
+	DefaultMaxSize  = 10 << 20
+	DefaultMaxFiles = 10
+
+	redacted = "<redacted>"
+)
+
+var secretKeyRegexp = regexp.MustCompile(`(?i)(password|secret|token|key|hash)`)
+
+// Entry is an audited api call. Params holds the route variables, the query
+// and the json body with secrets redacted.
+type Entry struct {
+	Time       time.Time              `json:"time"`
+	Source     string                 `json:"source"`
+	Identity   string                 `json:"identity,omitempty"`
+	Method     string                 `json:"method"`
+	Route      string                 `json:"route"`
+	Path       string                 `json:"path"`
+	Websocket  bool                   `json:"websocket,omitempty"`
+	Params     map[string]interface{} `json:"params,omitempty"`
+	Status     int                    `json:"status"`
+	Error      string                 `json:"error,omitempty"`
+	DurationMs int64                  `json:"durationms"`
+}
+
+// Logger appends entries as json lines. The log is rotated to LogFilename.1
+// and up when it grows over maxSize, maxFiles rotated logs are kept.
+type Logger struct {
+	dir      string
+	maxSize  int64
+	maxFiles int
+	mu       sync.Mutex
+	file     *os.File
+	size     int64
+}
+
+var singletonLogger *Logger = nil
+
+// Dir returns the audit directory of the pool, the runtime one when not
+// installed.
+func Dir(poolName string) string {
+	if poolName == "" {
+		return RuntimeDir
+	}
+	return fmt.Sprintf("/%v/audit", poolName)
+}
+
+func NewOrGetLogger(dir string, maxSize int64, maxFiles int) (*Logger, error) {
+	if singletonLogger != nil {
+		return singletonLogger, nil
+	}
+	if maxSize <= 0 {
+		maxSize = DefaultMaxSize
+	}
+	if maxFiles <= 0 {
+		maxFiles = DefaultMaxFiles
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, errors.Wrapf(err, "cannot create %v", dir)
+	}
+	l := &Logger{dir: dir, maxSize: maxSize, maxFiles: maxFiles}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	singletonLogger = l
+	return l, nil
+}
+
+func GetLogger() *Logger {
+	return singletonLogger
+}
+
+func (l *Logger) path(n int) string {
+	if n == 0 {
+		return filepath.Join(l.dir, LogFilename)
+	}
+	return filepath.Join(l.dir, fmt.Sprintf("%v.%v", LogFilename, n))
+}
+
+func (l *Logger) open() error {
+	f, err := os.OpenFile(l.path(0), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return errors.Wrapf(err, "cannot open audit log")
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return errors.Wrapf(err, "cannot stat audit log")
+	}
+	l.file, l.size = f, fi.Size()
+	return nil
+}
+
+// rotate shifts the rotated logs and starts a new log, it is called with the
+// lock held.
+func (l *Logger) rotate() error {
+	l.file.Close()
+	os.Remove(l.path(l.maxFiles))
+	for n := l.maxFiles - 1; n >= 0; n-- {
+		if err := os.Rename(l.path(n), l.path(n+1)); err != nil && !os.IsNotExist(err) {
+			return errors.Wrapf(err, "cannot rotate audit log")
+		}
+	}
+	return l.open()
+}
+
+// Log appends e to the log. Failures are logged, they do not fail the
+// audited call.
+func (l *Logger) Log(e *Entry) {
+	data, err := json.Marshal(e)
+	if err != nil {
+		klog.V(0).Error(err, "cannot encode audit entry")
+		return
+	}
+	data = append(data, '\n')
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.size+int64(len(data)) > l.maxSize && l.size > 0 {
+		if err := l.rotate(); err != nil {
+			klog.V(0).Error(err, "cannot rotate audit log")
+			if l.file == nil {
+				return
+			}
+		}
+	}
+	n, err := l.file.Write(data)
+	l.size += int64(n)
+	if err != nil {
+		klog.V(0).Error(err, "cannot write audit entry")
+	}
+}
+
+// Query filters entries. Zero fields match everything.
+type Query struct {
+	Since    time.Time
+	Until    time.Time
+	Identity string
+	Source   string
+	Route    string
+	Limit    int
+}
+
+func (q *Query) match(e *Entry) bool {
+	return (q.Since.IsZero() || !e.Time.Before(q.Since)) &&
+		(q.Until.IsZero() || e.Time.Before(q.Until)) &&
+		(q.Identity == "" || e.Identity == q.Identity) &&
+		(q.Source == "" || e.Source == q.Source) &&
+		(q.Route == "" || e.Route == q.Route)
+}
+
+// Query returns the matching entries, newest first.
+func (l *Logger) Query(q Query) ([]*Entry, error) {
+	result := []*Entry{}
+	for n := 0; n <= l.maxFiles; n++ {
+		entries, err := l.read(n)
+		if err != nil {
+			if os.IsNotExist(errors.Cause(err)) {
+				break
+			}
+			return nil, err
+		}
+		for i := len(entries) - 1; i >= 0; i-- {
+			if !q.match(entries[i]) {
+				continue
+			}
+			result = append(result, entries[i])
+			if q.Limit > 0 && len(result) >= q.Limit {
+				return result, nil
+			}
+		}
+	}
+	return result, nil
+}
+
+// read returns the entries of a log file, oldest first.
+func (l *Logger) read(n int) ([]*Entry, error) {
+	l.mu.Lock()
+	f, err := os.Open(l.path(n))
+	l.mu.Unlock()
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot open audit log")
+	}
+	defer f.Close()
+	var entries []*Entry
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1<<20)
+	for scanner.Scan() {
+		var e Entry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			continue
+		}
+		entries = append(entries, &e)
+	}
+	return entries, scanner.Err()
+}
+
+// Redact replaces the values of secret looking keys in v, which is decoded
+// json.
+func Redact(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		for k, val := range t {
+			if secretKeyRegexp.MatchString(k) {
+				t[k] = redacted
+			} else {
+				t[k] = Redact(val)
+			}
+		}
+	case []interface{}:
+		for i := range t {
+			t[i] = Redact(t[i])
+		}
+	}
+	return v
+}
+
+type entryKey struct{}
+
+// WithEntry returns a context carrying the entry of the audited call.
+func WithEntry(ctx context.Context, e *Entry) context.Context {
+	return context.WithValue(ctx, entryKey{}, e)
+}
+
+// SetIdentity records who made the audited call of ctx.
+func SetIdentity(ctx context.Context, identity string) {
+	if e, ok := ctx.Value(entryKey{}).(*Entry); ok {
+		e.Identity = identity
+	}
+}
+
+// AddParam records a parameter of the audited call of ctx which is not in
+// the request, like the messages of a websocket. value is redacted.
+func AddParam(ctx context.Context, name string, value interface{}) {
+	e, ok := ctx.Value(entryKey{}).(*Entry)
+	if !ok {
+		return
+	}
+	// round trip through json to redact structs too
+	var decoded interface{}
+	if data, err := json.Marshal(value); err == nil && json.Unmarshal(data, &decoded) == nil {
+		value = Redact(decoded)
+	}
+	if e.Params == nil {
+		e.Params = make(map[string]interface{})
+	}
+	if secretKeyRegexp.MatchString(name) {
+		value = redacted
+	}
+	e.Params[name] = value
+}
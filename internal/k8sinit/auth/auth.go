@@ -0,0 +1,253 @@
+/*
+Copyright 2020 Kazım SARIKAYA
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/bcrypt"
+	"io/ioutil"
+	klog "k8s.io/klog/v2"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	AdminUsername = "admin"
+
+	MinPasswordLength = 8
+	SessionTTL        = 12 * time.Hour
+
+	// SetupTokenFile keeps the setup token of a system which is not
+	// installed for the local console
+	SetupTokenFile = "/run/k8sinit/setup-token"
+
+	credentialFilename = "auth.json"
+	bcryptCost         = 12
+)
+
+var (
+	BadCredentialsError = errors.New("bad username or password")
+	BadPasswordError    = fmt.Errorf("password should be at least %v characters", MinPasswordLength)
+	NoSessionError      = errors.New("no valid session")
+)
+
+// Credential is the admin credential stored in the config dataset.
+type Credential struct {
+	Username     string `json:"username"`
+	PasswordHash string `json:"passwordhash"`
+}
+
+// Session is a login or a named token. The token of a login is sent as a
+// cookie by the web ui and as a bearer token by automation.
+type Session struct {
+	Username string    `json:"username"`
+	Scopes   []Scope   `json:"scopes"`
+	Expires  time.Time `json:"expires"`
+}
+
+// Allows reports whether one of the scopes of s includes required.
+func (s *Session) Allows(required Scope) bool {
+	for _, scope := range s.Scopes {
+		if scope.Allows(required) {
+			return true
+		}
+	}
+	return false
+}
+
+// Authenticator checks credentials and keeps the sessions. Before install
+// there is no credential, a setup token logged at boot is accepted instead.
+type Authenticator struct {
+	mu         sync.Mutex
+	file       string
+	credential *Credential
+	setupToken string
+	// sessions are keyed by the sha256 of their token
+	sessions   map[string]*Session
+	tokensFile string
+	tokens     map[string]*Token
+}
+
+var singletonAuthenticator *Authenticator = nil
+
+func credentialFile(poolName string) string {
+	return fmt.Sprintf("/%v/config/%v", poolName, credentialFilename)
+}
+
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", errors.Wrapf(err, "cannot generate token")
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func tokenKey(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// NewOrGetAuthenticator loads the credential of the pool. An empty poolName
+// means the system is not installed.
+func NewOrGetAuthenticator(poolName string) (*Authenticator, error) {
+	if singletonAuthenticator != nil {
+		return singletonAuthenticator, nil
+	}
+	a := &Authenticator{sessions: make(map[string]*Session), tokens: make(map[string]*Token)}
+	if poolName != "" {
+		a.file = credentialFile(poolName)
+		a.tokensFile = tokensFile(poolName)
+		if err := a.loadTokens(); err != nil {
+			return nil, err
+		}
+		data, err := ioutil.ReadFile(a.file)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, errors.Wrapf(err, "cannot read %v", a.file)
+		}
+		if err == nil {
+			var c Credential
+			if err := json.Unmarshal(data, &c); err != nil {
+				return nil, errors.Wrapf(err, "cannot decode %v", a.file)
+			}
+			a.credential = &c
+		}
+	}
+	if a.credential == nil {
+		token, err := randomToken()
+		if err != nil {
+			return nil, err
+		}
+		a.setupToken = token[:20]
+		if err := os.MkdirAll(filepath.Dir(SetupTokenFile), 0700); err == nil {
+			ioutil.WriteFile(SetupTokenFile, []byte(a.setupToken+"\n"), 0600)
+		}
+		klog.V(0).Infof("no admin credential, login as %v with setup token %v", AdminUsername, a.setupToken)
+	}
+	singletonAuthenticator = a
+	return a, nil
+}
+
+func GetAuthenticator() *Authenticator {
+	return singletonAuthenticator
+}
+
+// HashPassword returns the bcrypt hash of password.
+func HashPassword(password string) (string, error) {
+	if len(password) < MinPasswordLength {
+		return "", BadPasswordError
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcryptCost)
+	if err != nil {
+		return "", errors.Wrapf(err, "cannot hash password")
+	}
+	return string(hash), nil
+}
+
+// WriteCredential stores the admin credential in the config dataset of the
+// pool.
+func WriteCredential(poolName, password string) error {
+	hash, err := HashPassword(password)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(Credential{Username: AdminUsername, PasswordHash: hash})
+	if err != nil {
+		return errors.Wrapf(err, "cannot encode credential")
+	}
+	file := credentialFile(poolName)
+	tmp := file + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return errors.Wrapf(err, "cannot write %v", tmp)
+	}
+	return os.Rename(tmp, file)
+}
+
+// Login checks the credential and starts a session.
+func (a *Authenticator) Login(username, password string) (string, *Session, error) {
+	a.mu.Lock()
+	cred, setupToken := a.credential, a.setupToken
+	a.mu.Unlock()
+	ok := false
+	if cred != nil {
+		ok = subtle.ConstantTimeCompare([]byte(username), []byte(cred.Username)) == 1 &&
+			bcrypt.CompareHashAndPassword([]byte(cred.PasswordHash), []byte(password)) == nil
+	} else if setupToken != "" {
+		ok = username == AdminUsername && subtle.ConstantTimeCompare([]byte(password), []byte(setupToken)) == 1
+	}
+	if !ok {
+		// slow down guessing
+		time.Sleep(time.Second)
+		return "", nil, BadCredentialsError
+	}
+	token, err := randomToken()
+	if err != nil {
+		return "", nil, err
+	}
+	s := &Session{Username: username, Scopes: []Scope{ScopeAdmin}, Expires: time.Now().Add(SessionTTL)}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.expireSessions()
+	a.sessions[tokenKey(token)] = s
+	return token, s, nil
+}
+
+// Logout ends the session of token.
+func (a *Authenticator) Logout(token string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.sessions, tokenKey(token))
+}
+
+// Authenticate returns the session of a login token or a named token.
+func (a *Authenticator) Authenticate(token string) (*Session, error) {
+	if token == "" {
+		return nil, NoSessionError
+	}
+	key := tokenKey(token)
+	now := time.Now()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	s, ok := a.sessions[key]
+	if !ok {
+		if s = a.tokenSession(key, now); s == nil {
+			return nil, NoSessionError
+		}
+		return s, nil
+	}
+	if now.After(s.Expires) {
+		delete(a.sessions, key)
+		return nil, NoSessionError
+	}
+	return s, nil
+}
+
+func (a *Authenticator) expireSessions() {
+	now := time.Now()
+	for k, s := range a.sessions {
+		if now.After(s.Expires) {
+			delete(a.sessions, k)
+		}
+	}
+}
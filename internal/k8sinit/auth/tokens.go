@@ -0,0 +1,215 @@
+/*
+Copyright 2020 Kazım SARIKAYA
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package auth
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"time"
+)
+
+// Scope is a permission level of the api. Each scope includes the ones
+// below it, admin can do anything.
+type Scope string
+
+const (
+	ScopeNone  Scope = ""
+	ScopeBoot  Scope = "boot"
+	ScopeRead  Scope = "read"
+	ScopeWrite Scope = "write"
+	ScopeAdmin Scope = "admin"
+
+	tokensFilename = "tokens.json"
+)
+
+var scopeLevels = map[Scope]int{ScopeNone: 0, ScopeBoot: 1, ScopeRead: 2, ScopeWrite: 3, ScopeAdmin: 4}
+
+var (
+	tokenNameRegexp = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+
+	TokenExistsError   = errors.New("token exists")
+	TokenNotFoundError = errors.New("token not found")
+	BadTokenError      = errors.New("bad token")
+	ForbiddenError     = errors.New("scope is not granted")
+)
+
+// Allows reports whether s includes required.
+func (s Scope) Allows(required Scope) bool {
+	level, ok := scopeLevels[s]
+	return ok && level >= scopeLevels[required]
+}
+
+// Token is a named api token. Only the sha256 of the secret is kept.
+type Token struct {
+	Name    string     `json:"name"`
+	Scopes  []Scope    `json:"scopes"`
+	Created time.Time  `json:"created"`
+	Expires *time.Time `json:"expires,omitempty"`
+	Hash    string     `json:"hash,omitempty"`
+}
+
+func (t *Token) expired(now time.Time) bool {
+	return t.Expires != nil && now.After(*t.Expires)
+}
+
+// Validate checks the name and the scopes of a new token.
+func (t *Token) Validate() error {
+	if !tokenNameRegexp.MatchString(t.Name) {
+		return errors.Wrapf(BadTokenError, "bad name %v", t.Name)
+	}
+	if len(t.Scopes) == 0 {
+		return errors.Wrapf(BadTokenError, "no scopes")
+	}
+	for _, s := range t.Scopes {
+		if _, ok := scopeLevels[s]; !ok || s == ScopeNone {
+			return errors.Wrapf(BadTokenError, "unknown scope %v", s)
+		}
+	}
+	if t.Expires != nil && !t.Expires.After(time.Now()) {
+		return errors.Wrapf(BadTokenError, "expiry is in the past")
+	}
+	return nil
+}
+
+func tokensFile(poolName string) string {
+	return fmt.Sprintf("/%v/config/%v", poolName, tokensFilename)
+}
+
+func (a *Authenticator) loadTokens() error {
+	if a.tokensFile == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(a.tokensFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return errors.Wrapf(err, "cannot read %v", a.tokensFile)
+	}
+	var tokens []*Token
+	if err := json.Unmarshal(data, &tokens); err != nil {
+		return errors.Wrapf(err, "cannot decode %v", a.tokensFile)
+	}
+	for _, t := range tokens {
+		a.tokens[t.Name] = t
+	}
+	return nil
+}
+
+// saveTokens writes the tokens, it is called with the lock held. Tokens of
+// a system which is not installed are not persisted.
+func (a *Authenticator) saveTokens() error {
+	if a.tokensFile == "" {
+		return nil
+	}
+	tokens := make([]*Token, 0, len(a.tokens))
+	for _, t := range a.tokens {
+		tokens = append(tokens, t)
+	}
+	sort.Slice(tokens, func(i, j int) bool {
+		return tokens[i].Name < tokens[j].Name
+	})
+	data, err := json.MarshalIndent(tokens, "", "  ")
+	if err != nil {
+		return errors.Wrapf(err, "cannot encode tokens")
+	}
+	tmp := a.tokensFile + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return errors.Wrapf(err, "cannot write %v", tmp)
+	}
+	return os.Rename(tmp, a.tokensFile)
+}
+
+// CreateToken adds a named token and returns its secret, which cannot be
+// read again.
+func (a *Authenticator) CreateToken(t Token) (string, Token, error) {
+	if err := t.Validate(); err != nil {
+		return "", Token{}, err
+	}
+	secret, err := randomToken()
+	if err != nil {
+		return "", Token{}, err
+	}
+	t.Created = time.Now()
+	t.Hash = tokenKey(secret)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, ok := a.tokens[t.Name]; ok {
+		return "", Token{}, TokenExistsError
+	}
+	stored := t
+	a.tokens[t.Name] = &stored
+	if err := a.saveTokens(); err != nil {
+		delete(a.tokens, t.Name)
+		return "", Token{}, err
+	}
+	t.Hash = ""
+	return secret, t, nil
+}
+
+// RevokeToken deletes the named token.
+func (a *Authenticator) RevokeToken(name string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	t, ok := a.tokens[name]
+	if !ok {
+		return TokenNotFoundError
+	}
+	delete(a.tokens, name)
+	if err := a.saveTokens(); err != nil {
+		a.tokens[name] = t
+		return err
+	}
+	return nil
+}
+
+// Tokens lists the named tokens without their hashes.
+func (a *Authenticator) Tokens() []Token {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	result := make([]Token, 0, len(a.tokens))
+	for _, t := range a.tokens {
+		c := *t
+		c.Hash = ""
+		result = append(result, c)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name < result[j].Name
+	})
+	return result
+}
+
+// tokenSession returns a session for a named token, it is called with the
+// lock held.
+func (a *Authenticator) tokenSession(key string, now time.Time) *Session {
+	for _, t := range a.tokens {
+		if t.Hash != key || t.expired(now) {
+			continue
+		}
+		s := &Session{Username: "token:" + t.Name, Scopes: t.Scopes}
+		if t.Expires != nil {
+			s.Expires = *t.Expires
+		}
+		return s
+	}
+	return nil
+}
@@ -0,0 +1,289 @@
+/*
+Copyright 2020 Kazım SARIKAYA
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package boot
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"github.com/kazimsarikaya/k8sinit/internal/k8sinit"
+	"github.com/pkg/errors"
+	"io"
+	klog "k8s.io/klog/v2"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// WriteTimeout is the time a boot file transfer may make no progress. It
+// replaces the write timeout of the server for the whole response, which
+// large initrds to slow clients cannot meet.
+const WriteTimeout = 30 * time.Second
+
+var (
+	BadFileNameError  = errors.New("bad file name")
+	QueueFullError    = errors.New("too many boot file transfers")
+	FileNotFoundError = errors.New("boot file not found")
+)
+
+type connKey struct{}
+
+// ConnContext keeps the connection of a request in its context so transfers
+// can set their write deadlines, it is meant as http.Server.ConnContext.
+func ConnContext(ctx context.Context, c net.Conn) context.Context {
+	return context.WithValue(ctx, connKey{}, c)
+}
+
+// deadlineWriter extends the write deadline of conn before each write.
+type deadlineWriter struct {
+	http.ResponseWriter
+	conn net.Conn
+}
+
+func (w *deadlineWriter) Write(b []byte) (int, error) {
+	w.conn.SetWriteDeadline(time.Now().Add(WriteTimeout))
+	return w.ResponseWriter.Write(b)
+}
+
+// TransferStats are the counters of the boot file server. Waits are the
+// times transfers spent queued.
+type TransferStats struct {
+	Active       int64  `json:"active"`
+	Queued       int64  `json:"queued"`
+	MaxTransfers int    `json:"maxtransfers"`
+	MaxQueue     int    `json:"maxqueue"`
+	Served       uint64 `json:"served"`
+	Failed       uint64 `json:"failed"`
+	Rejected     uint64 `json:"rejected"`
+	Bytes        uint64 `json:"bytes"`
+	TotalWaitMs  uint64 `json:"totalwaitms"`
+	MaxWaitMs    uint64 `json:"maxwaitms"`
+}
+
+// checksum is the sha256 of a version of a file. Its lock is held while the
+// file is hashed, so clients booting together wait for one hash of it.
+type checksum struct {
+	mu      sync.Mutex
+	size    int64
+	modTime time.Time
+	sum     []byte
+}
+
+// FileServer serves boot files to many clients at once. At most maxTransfers
+// files are sent at a time, up to maxQueue more requests wait for a slot and
+// the rest are turned away.
+type FileServer struct {
+	dir      string
+	slots    chan struct{}
+	maxQueue int
+	// sumMu guards the map, each checksum has its own lock
+	sumMu     sync.Mutex
+	checksums map[string]*checksum
+	stats     TransferStats
+}
+
+var singletonFileServer *FileServer = nil
+
+// NewOrGetFileServer creates the boot file server. dir is the boot dataset
+// of the pool, empty when not installed.
+func NewOrGetFileServer(dir string, maxTransfers, maxQueue int) *FileServer {
+	if singletonFileServer != nil {
+		return singletonFileServer
+	}
+	singletonFileServer = &FileServer{
+		dir:       dir,
+		slots:     make(chan struct{}, maxTransfers),
+		maxQueue:  maxQueue,
+		checksums: make(map[string]*checksum),
+		stats:     TransferStats{MaxTransfers: maxTransfers, MaxQueue: maxQueue},
+	}
+	return singletonFileServer
+}
+
+func GetFileServer() *FileServer {
+	return singletonFileServer
+}
+
+func (s *FileServer) Stats() TransferStats {
+	return TransferStats{
+		Active:       atomic.LoadInt64(&s.stats.Active),
+		Queued:       atomic.LoadInt64(&s.stats.Queued),
+		MaxTransfers: s.stats.MaxTransfers,
+		MaxQueue:     s.stats.MaxQueue,
+		Served:       atomic.LoadUint64(&s.stats.Served),
+		Failed:       atomic.LoadUint64(&s.stats.Failed),
+		Rejected:     atomic.LoadUint64(&s.stats.Rejected),
+		Bytes:        atomic.LoadUint64(&s.stats.Bytes),
+		TotalWaitMs:  atomic.LoadUint64(&s.stats.TotalWaitMs),
+		MaxWaitMs:    atomic.LoadUint64(&s.stats.MaxWaitMs),
+	}
+}
+
+// acquire waits for a transfer slot until ctx is done.
+func (s *FileServer) acquire(ctx context.Context) error {
+	if atomic.AddInt64(&s.stats.Queued, 1) > int64(s.maxQueue)+int64(cap(s.slots)-len(s.slots)) {
+		atomic.AddInt64(&s.stats.Queued, -1)
+		atomic.AddUint64(&s.stats.Rejected, 1)
+		return QueueFullError
+	}
+	defer atomic.AddInt64(&s.stats.Queued, -1)
+	start := time.Now()
+	select {
+	case s.slots <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	wait := uint64(time.Since(start).Milliseconds())
+	atomic.AddUint64(&s.stats.TotalWaitMs, wait)
+	for {
+		max := atomic.LoadUint64(&s.stats.MaxWaitMs)
+		if wait <= max || atomic.CompareAndSwapUint64(&s.stats.MaxWaitMs, max, wait) {
+			break
+		}
+	}
+	atomic.AddInt64(&s.stats.Active, 1)
+	return nil
+}
+
+func (s *FileServer) release() {
+	atomic.AddInt64(&s.stats.Active, -1)
+	<-s.slots
+}
+
+// sum returns the sha256 checksum of f, it is computed once per version of the
+// file.
+func (s *FileServer) sum(path string, f *os.File, fi os.FileInfo) ([]byte, error) {
+	s.sumMu.Lock()
+	c, ok := s.checksums[path]
+	if !ok {
+		c = &checksum{}
+		s.checksums[path] = c
+	}
+	s.sumMu.Unlock()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.sum != nil && c.size == fi.Size() && c.modTime.Equal(fi.ModTime()) {
+		return c.sum, nil
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, io.NewSectionReader(f, 0, fi.Size())); err != nil {
+		return nil, errors.Wrapf(err, "cannot read %v", path)
+	}
+	c.size, c.modTime, c.sum = fi.Size(), fi.ModTime(), h.Sum(nil)
+	return c.sum, nil
+}
+
+// ServeBootFile sends name from the boot dataset of the pool. Errors are
+// returned before anything is written, like the ones of ServeFile.
+func (s *FileServer) ServeBootFile(w http.ResponseWriter, r *http.Request, name string) error {
+	if name == "" || strings.Contains(name, "/") || strings.HasPrefix(name, ".") {
+		return BadFileNameError
+	}
+	if s.dir == "" {
+		return k8sinit.K8SInitNotInstalledError
+	}
+	return s.ServeFile(w, r, filepath.Join(s.dir, name))
+}
+
+// ServeFile sends the file at path with its checksum as etag. Ranges let
+// clients resume broken downloads. It returns FileNotFoundError,
+// QueueFullError, the error of the request context when the client left
+// while queued or another error before the response is started, the caller
+// writes the error response. Failures during the transfer are counted in
+// the stats.
+func (s *FileServer) ServeFile(w http.ResponseWriter, r *http.Request, path string) error {
+	if err := s.acquire(r.Context()); err != nil {
+		return err
+	}
+	defer s.release()
+
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return FileNotFoundError
+		}
+		return errors.Wrapf(err, "cannot open %v", path)
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil || !fi.Mode().IsRegular() {
+		return FileNotFoundError
+	}
+	sum, err := s.sum(path, f, fi)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("ETag", strconv.Quote(hex.EncodeToString(sum)))
+	w.Header().Set("Digest", "sha-256="+base64.StdEncoding.EncodeToString(sum))
+	if w.Header().Get("Content-Type") == "" {
+		w.Header().Set("Content-Type", "application/octet-stream")
+	}
+
+	cw := &countingWriter{ResponseWriter: w}
+	if conn, ok := r.Context().Value(connKey{}).(net.Conn); ok {
+		cw.ResponseWriter = &deadlineWriter{ResponseWriter: w, conn: conn}
+		// kept alive connections must not inherit the last deadline
+		defer conn.SetWriteDeadline(time.Time{})
+	}
+	start := time.Now()
+	http.ServeContent(cw, r, "", fi.ModTime(), f)
+	atomic.AddUint64(&s.stats.Bytes, uint64(cw.bytes))
+
+	client, _, _ := net.SplitHostPort(r.RemoteAddr)
+	kv := []interface{}{"client", client, "file", path, "range", r.Header.Get("Range"),
+		"bytes", cw.bytes, "duration", time.Since(start)}
+	length, err := strconv.ParseInt(w.Header().Get("Content-Length"), 10, 64)
+	if r.Method != http.MethodHead && cw.status < 300 && err == nil && cw.bytes < length {
+		atomic.AddUint64(&s.stats.Failed, 1)
+		klog.V(0).Error(fmt.Errorf("transfer interrupted"), "boot file transfer failed", kv...)
+		return nil
+	}
+	atomic.AddUint64(&s.stats.Served, 1)
+	klog.V(0).InfoS("boot file transfer done", kv...)
+	return nil
+}
+
+type countingWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *countingWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *countingWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
@@ -0,0 +1,355 @@
+/*
+Copyright 2020 Kazım SARIKAYA
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package boot
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/kazimsarikaya/k8sinit/internal/k8sinit"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	klog "k8s.io/klog/v2"
+	"net"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+const DefaultProfileName = "default"
+
+var (
+	ProfileNotFoundError = errors.New("boot profile not found")
+	ProfileExistsError   = errors.New("boot profile already exists")
+
+	profileNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+)
+
+type ProfileValidationError struct {
+	Reason string
+}
+
+func (e *ProfileValidationError) Error() string {
+	return "invalid boot profile: " + e.Reason
+}
+
+// Profile describes what a pxe client boots. Kernel and Initrd are either
+// file names in the boot dataset of the pool or absolute http urls. A client
+// gets the profile listing its mac, else its ip, else its lease group which
+// is the dhcp scope of its lease. Clients matching nothing get the default
+// profile.
+type Profile struct {
+	Name   string   `json:"name"`
+	Kernel string   `json:"kernel"`
+	Initrd string   `json:"initrd"`
+	Args   string   `json:"args,omitempty"`
+	Role   string   `json:"role"`
+	MACs   []string `json:"macs,omitempty"`
+	IPs    []string `json:"ips,omitempty"`
+	Groups []string `json:"groups,omitempty"`
+}
+
+// defaultProfile boots the image of the manager into the pool it is
+// installed on.
+func defaultProfile(poolName string) *Profile {
+	return &Profile{
+		Name:   DefaultProfileName,
+		Kernel: "vmlinuz",
+		Initrd: "initramfs",
+		Args:   "k8sinit.pool=" + poolName,
+		Role:   k8sinit.RoleNode,
+	}
+}
+
+type Profiles struct {
+	poolName string
+	file     string
+	mu       sync.Mutex
+	profiles map[string]*Profile
+}
+
+var singletonProfiles *Profiles = nil
+
+func NewOrGetProfiles(poolName string) (*Profiles, error) {
+	if singletonProfiles != nil {
+		return singletonProfiles, nil
+	}
+	if poolName == "" {
+		return nil, k8sinit.K8SInitNotInstalledError
+	}
+	ps := &Profiles{
+		poolName: poolName,
+		file:     fmt.Sprintf("/%v/config/bootprofiles.json", poolName),
+		profiles: make(map[string]*Profile),
+	}
+	data, err := ioutil.ReadFile(ps.file)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, errors.Wrapf(err, "cannot read boot profiles file %v", ps.file)
+	}
+	if err == nil {
+		var profiles []*Profile
+		if err := json.Unmarshal(data, &profiles); err != nil {
+			return nil, errors.Wrapf(err, "cannot decode boot profiles file %v", ps.file)
+		}
+		for _, p := range profiles {
+			if p == nil {
+				continue
+			}
+			// the file may be edited by hand, its fields end up in ipxe
+			// scripts as they are
+			if err := ps.validate(p, ""); err != nil {
+				klog.V(0).Error(err, "skipping boot profile", "name", p.Name, "file", ps.file)
+				continue
+			}
+			ps.profiles[p.Name] = p
+		}
+	}
+	if _, ok := ps.profiles[DefaultProfileName]; !ok {
+		ps.profiles[DefaultProfileName] = defaultProfile(poolName)
+	}
+	singletonProfiles = ps
+	return ps, nil
+}
+
+func GetProfiles() *Profiles {
+	return singletonProfiles
+}
+
+// save should be called with ps.mu held.
+func (ps *Profiles) save() error {
+	data, err := json.MarshalIndent(ps.list(), "", "  ")
+	if err != nil {
+		return errors.Wrapf(err, "cannot encode boot profiles")
+	}
+	tmp := ps.file + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return errors.Wrapf(err, "cannot write boot profiles file %v", tmp)
+	}
+	if err := os.Rename(tmp, ps.file); err != nil {
+		return errors.Wrapf(err, "cannot replace boot profiles file %v", ps.file)
+	}
+	return nil
+}
+
+func (ps *Profiles) list() []Profile {
+	result := make([]Profile, 0, len(ps.profiles))
+	for _, p := range ps.profiles {
+		result = append(result, *p)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name < result[j].Name
+	})
+	return result
+}
+
+func isUrl(s string) bool {
+	return strings.HasPrefix(s, "http://") || strings.HasPrefix(s, "https://")
+}
+
+// hasControl reports whether s has control characters. Profile fields are
+// written into ipxe scripts as they are, a newline would start a command.
+func hasControl(s string) bool {
+	return strings.IndexFunc(s, unicode.IsControl) >= 0
+}
+
+// validBootFile accepts file names and urls without spaces, ipxe splits
+// command arguments at them.
+func validBootFile(s string) bool {
+	if hasControl(s) || strings.IndexFunc(s, unicode.IsSpace) >= 0 {
+		return false
+	}
+	return isUrl(s) || (s != "" && s != "." && s != ".." && !strings.Contains(s, "/"))
+}
+
+// validate normalizes p and checks that its selectors are not used by
+// another profile, ignoring the profile named skip.
+func (ps *Profiles) validate(p *Profile, skip string) error {
+	if !profileNameRegexp.MatchString(p.Name) {
+		return &ProfileValidationError{Reason: fmt.Sprintf("bad name %q", p.Name)}
+	}
+	if p.Role == "" {
+		p.Role = k8sinit.RoleNode
+	}
+	if p.Role != k8sinit.RoleNode && p.Role != k8sinit.RoleManager {
+		return &ProfileValidationError{Reason: fmt.Sprintf("bad role %q", p.Role)}
+	}
+	if !validBootFile(p.Kernel) {
+		return &ProfileValidationError{Reason: fmt.Sprintf("bad kernel %q", p.Kernel)}
+	}
+	if !validBootFile(p.Initrd) {
+		return &ProfileValidationError{Reason: fmt.Sprintf("bad initrd %q", p.Initrd)}
+	}
+	if hasControl(p.Args) {
+		return &ProfileValidationError{Reason: "args have control characters"}
+	}
+	if p.Name == DefaultProfileName && (len(p.MACs) > 0 || len(p.IPs) > 0 || len(p.Groups) > 0) {
+		return &ProfileValidationError{Reason: "default profile cannot have selectors"}
+	}
+	for i, mac := range p.MACs {
+		hw, err := net.ParseMAC(mac)
+		if err != nil {
+			return &ProfileValidationError{Reason: fmt.Sprintf("bad mac address %v", mac)}
+		}
+		p.MACs[i] = hw.String()
+	}
+	for i, ip := range p.IPs {
+		nip := net.ParseIP(ip).To4()
+		if nip == nil {
+			return &ProfileValidationError{Reason: fmt.Sprintf("bad ip address %v", ip)}
+		}
+		p.IPs[i] = nip.String()
+	}
+	for name, o := range ps.profiles {
+		if name == skip || name == p.Name {
+			continue
+		}
+		for _, sel := range [][2][]string{{p.MACs, o.MACs}, {p.IPs, o.IPs}, {p.Groups, o.Groups}} {
+			for _, a := range sel[0] {
+				for _, b := range sel[1] {
+					if a == b {
+						return &ProfileValidationError{Reason: fmt.Sprintf("%v is used by profile %v", a, name)}
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (ps *Profiles) List() []Profile {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	return ps.list()
+}
+
+func (ps *Profiles) Get(name string) (Profile, error) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	p, ok := ps.profiles[name]
+	if !ok {
+		return Profile{}, ProfileNotFoundError
+	}
+	return *p, nil
+}
+
+func (ps *Profiles) Add(p Profile) (Profile, error) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if err := ps.validate(&p, ""); err != nil {
+		return Profile{}, err
+	}
+	if _, ok := ps.profiles[p.Name]; ok {
+		return Profile{}, ProfileExistsError
+	}
+	ps.profiles[p.Name] = &p
+	if err := ps.save(); err != nil {
+		delete(ps.profiles, p.Name)
+		return Profile{}, err
+	}
+	return p, nil
+}
+
+// Update replaces the profile name with p. Profiles cannot be renamed.
+func (ps *Profiles) Update(name string, p Profile) (Profile, error) {
+	if p.Name == "" {
+		p.Name = name
+	}
+	if p.Name != name {
+		return Profile{}, &ProfileValidationError{Reason: "profile cannot be renamed"}
+	}
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	old, ok := ps.profiles[name]
+	if !ok {
+		return Profile{}, ProfileNotFoundError
+	}
+	if err := ps.validate(&p, name); err != nil {
+		return Profile{}, err
+	}
+	ps.profiles[name] = &p
+	if err := ps.save(); err != nil {
+		ps.profiles[name] = old
+		return Profile{}, err
+	}
+	return p, nil
+}
+
+// Delete removes the profile name. Deleting the default profile restores
+// the built-in one.
+func (ps *Profiles) Delete(name string) error {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	old, ok := ps.profiles[name]
+	if !ok {
+		return ProfileNotFoundError
+	}
+	delete(ps.profiles, name)
+	if name == DefaultProfileName {
+		ps.profiles[name] = defaultProfile(ps.poolName)
+	}
+	if err := ps.save(); err != nil {
+		ps.profiles[name] = old
+		return err
+	}
+	return nil
+}
+
+// Resolve returns the profile of a client. mac and ip may be empty, group is
+// the lease group of the client if it has a lease.
+func (ps *Profiles) Resolve(mac, ip, group string) Profile {
+	if hw, err := net.ParseMAC(mac); err == nil {
+		mac = hw.String()
+	}
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	var byIP, byGroup *Profile
+	for _, p := range ps.profiles {
+		for _, m := range p.MACs {
+			if mac != "" && m == mac {
+				return *p
+			}
+		}
+		for _, i := range p.IPs {
+			if ip != "" && i == ip {
+				byIP = p
+			}
+		}
+		for _, g := range p.Groups {
+			if group != "" && g == group {
+				byGroup = p
+			}
+		}
+	}
+	if byIP != nil {
+		return *byIP
+	}
+	if byGroup != nil {
+		return *byGroup
+	}
+	return *ps.profiles[DefaultProfileName]
+}
+
+// BootFileUrl returns the url of a kernel or initrd of a profile, files of
+// the boot dataset are served under base.
+func BootFileUrl(base, file string) string {
+	if isUrl(file) {
+		return file
+	}
+	return base + "/" + file
+}
@@ -0,0 +1,331 @@
+/*
+Copyright 2020 Kazım SARIKAYA
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package k8sinit
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"path/filepath"
+	"regexp"
+	"text/template"
+	"time"
+)
+
+const (
+	DefaultDhcpLeaseTime    = time.Minute * 30
+	DefaultHostnameTemplate = "node-{{.MacSuffix}}"
+	DefaultTftpUploadQuota  = 64 << 20
+	DefaultTftpMaxUpload    = 16 << 20
+	DefaultMaxBootTransfers = 32
+	DefaultMaxBootQueue     = 1024
+)
+
+var (
+	hostnameRegexp   = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?$`)
+	domainNameRegexp = regexp.MustCompile(`^([a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?\.)*[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?$`)
+
+	// options the dhcp server sets itself, they cannot be given as extra
+	// options. Router, dns, ntp and domains have their own fields, the boot
+	// options are chosen per client.
+	managedDhcpOptions = map[uint8]bool{
+		0: true, 1: true, 3: true, 6: true, 12: true, 15: true, 42: true, 50: true, 51: true,
+		53: true, 54: true, 60: true, 66: true, 67: true, 119: true, 255: true,
+	}
+)
+
+func ip2int(ip net.IP) uint32 {
+	return binary.BigEndian.Uint32(ip.To4())
+}
+
+func int2ip(n uint32) net.IP {
+	ip := make(net.IP, 4)
+	binary.BigEndian.PutUint32(ip, n)
+	return ip
+}
+
+func parseIPv4(s string) (net.IP, error) {
+	ip := net.ParseIP(s).To4()
+	if ip == nil {
+		return nil, fmt.Errorf("bad ipv4 address %v", s)
+	}
+	return ip, nil
+}
+
+// Validate checks the install config before anything is written to disk.
+func (ic *InstallConfig) Validate() error {
+	ip, subnet, err := net.ParseCIDR(ic.InternalNetworkIPAndPrefix)
+	if err != nil || ip.To4() == nil {
+		return fmt.Errorf("bad internal network address %v", ic.InternalNetworkIPAndPrefix)
+	}
+	if err := ic.Dhcp.Validate(subnet, ip); err != nil {
+		return fmt.Errorf("bad dhcp config: %v", err)
+	}
+	if ic.Tftp.Root != "" && !filepath.IsAbs(ic.Tftp.Root) {
+		return fmt.Errorf("tftp root %v is not an absolute path", ic.Tftp.Root)
+	}
+	if ic.Tftp.UploadQuota < 0 || ic.Tftp.MaxUploadSize < 0 {
+		return fmt.Errorf("tftp upload limits cannot be negative")
+	}
+	if err := ic.Http.Validate(ip); err != nil {
+		return fmt.Errorf("bad http config: %v", err)
+	}
+	if ic.Audit.MaxSize < 0 || ic.Audit.MaxFiles < 0 {
+		return fmt.Errorf("audit log limits cannot be negative")
+	}
+	for _, s := range ic.NtpServers {
+		if net.ParseIP(s) == nil && !domainNameRegexp.MatchString(s) {
+			return fmt.Errorf("bad ntp server %v", s)
+		}
+	}
+	return nil
+}
+
+func (c *TftpConfig) GetRoot(poolName string) string {
+	if c.Root == "" {
+		return fmt.Sprintf("/%v/tftp", poolName)
+	}
+	return filepath.Clean(c.Root)
+}
+
+// GetUploadDir returns the directory holding the uploads of tftp clients.
+func (c *TftpConfig) GetUploadDir(poolName string) string {
+	return fmt.Sprintf("/%v/uploads", poolName)
+}
+
+func (c *TftpConfig) GetUploadQuota() int64 {
+	if c.UploadQuota == 0 {
+		return DefaultTftpUploadQuota
+	}
+	return c.UploadQuota
+}
+
+func (c *TftpConfig) GetMaxUploadSize() int64 {
+	if c.MaxUploadSize == 0 {
+		return DefaultTftpMaxUpload
+	}
+	return c.MaxUploadSize
+}
+
+// Validate checks the addresses of c. The dhcp server sends pxe clients to
+// internalIP, so it must be one of the boot addresses.
+func (c *HttpConfig) Validate(internalIP net.IP) error {
+	if c.MaxBootTransfers < 0 || c.MaxBootQueue < 0 {
+		return fmt.Errorf("boot transfer limits cannot be negative")
+	}
+	for _, addrs := range [][]string{c.AdminAddresses, c.BootAddresses} {
+		for _, a := range addrs {
+			if net.ParseIP(a) == nil {
+				return fmt.Errorf("bad address %v", a)
+			}
+		}
+	}
+	if len(c.BootAddresses) == 0 {
+		return nil
+	}
+	for _, a := range c.BootAddresses {
+		if ip := net.ParseIP(a); ip.Equal(internalIP) || ip.IsUnspecified() {
+			return nil
+		}
+	}
+	return fmt.Errorf("boot addresses do not contain internal network address %v", internalIP)
+}
+
+func (c *HttpConfig) GetMaxBootTransfers() int {
+	if c.MaxBootTransfers == 0 {
+		return DefaultMaxBootTransfers
+	}
+	return c.MaxBootTransfers
+}
+
+func (c *HttpConfig) GetMaxBootQueue() int {
+	if c.MaxBootQueue == 0 {
+		return DefaultMaxBootQueue
+	}
+	return c.MaxBootQueue
+}
+
+// AdminListeners returns where the api and the ui are served.
+func (ic *InstallConfig) AdminListeners() []Listener {
+	if len(ic.Http.AdminAddresses) == 0 {
+		return []Listener{{Device: ic.AdminNetwork}}
+	}
+	return addressListeners(ic.Http.AdminAddresses)
+}
+
+// BootListeners returns where boot files are served.
+func (ic *InstallConfig) BootListeners() []Listener {
+	if len(ic.Http.BootAddresses) == 0 {
+		ip, _, _ := net.ParseCIDR(ic.InternalNetworkIPAndPrefix)
+		return []Listener{{IP: ip.String()}}
+	}
+	return addressListeners(ic.Http.BootAddresses)
+}
+
+func addressListeners(addrs []string) []Listener {
+	result := make([]Listener, 0, len(addrs))
+	for _, a := range addrs {
+		result = append(result, Listener{IP: a})
+	}
+	return result
+}
+
+func (l Listener) String() string {
+	ip := l.IP
+	if ip == "" {
+		ip = "*"
+	}
+	if l.Device != "" {
+		return ip + "%" + l.Device
+	}
+	return ip
+}
+
+// DefaultDhcpRange returns the default dhcp range of subnet. Bigger subnets
+// leave the first ten addresses for static use.
+func DefaultDhcpRange(subnet *net.IPNet) (net.IP, net.IP) {
+	ones, bits := subnet.Mask.Size()
+	size := uint32(1) << uint(bits-ones)
+	netaddr := ip2int(subnet.IP)
+	if size <= 2 {
+		return int2ip(netaddr), int2ip(netaddr + size - 1)
+	}
+	start := netaddr + 1
+	if size > 32 {
+		start = netaddr + 10
+	}
+	return int2ip(start), int2ip(netaddr + size - 2)
+}
+
+// Range returns the dhcp range of c in subnet, filling defaults.
+func (c *DhcpConfig) Range(subnet *net.IPNet) (net.IP, net.IP, error) {
+	start, end := DefaultDhcpRange(subnet)
+	var err error
+	if c.RangeStart != "" {
+		if start, err = parseIPv4(c.RangeStart); err != nil {
+			return nil, nil, err
+		}
+	}
+	if c.RangeEnd != "" {
+		if end, err = parseIPv4(c.RangeEnd); err != nil {
+			return nil, nil, err
+		}
+	}
+	return start, end, nil
+}
+
+func (c *DhcpConfig) GetLeaseTime() time.Duration {
+	if c.LeaseTime == 0 {
+		return DefaultDhcpLeaseTime
+	}
+	return time.Duration(c.LeaseTime) * time.Second
+}
+
+// GetHostnameTemplate parses the hostname template of c.
+func (c *DhcpConfig) GetHostnameTemplate() (*template.Template, error) {
+	text := c.HostnameTemplate
+	if text == "" {
+		text = DefaultHostnameTemplate
+	}
+	return template.New("hostname").Option("missingkey=error").Parse(text)
+}
+
+// RenderHostname renders the hostname template t for the client mac.
+func RenderHostname(t *template.Template, mac net.HardwareAddr) (string, error) {
+	data := HostnameData{MAC: hex.EncodeToString(mac)}
+	if len(mac) >= 3 {
+		data.MacSuffix = hex.EncodeToString(mac[len(mac)-3:])
+	}
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	name := buf.String()
+	if !hostnameRegexp.MatchString(name) {
+		return "", fmt.Errorf("bad hostname %v", name)
+	}
+	return name, nil
+}
+
+// Validate checks c against the subnet it serves. serverIP is the address of
+// the manager on the subnet, nil for relayed subnets.
+func (c *DhcpConfig) Validate(subnet *net.IPNet, serverIP net.IP) error {
+	if subnet.IP.To4() == nil {
+		return fmt.Errorf("subnet %v is not ipv4", subnet)
+	}
+	start, end, err := c.Range(subnet)
+	if err != nil {
+		return err
+	}
+	bcast := int2ip(ip2int(subnet.IP) | ^binary.BigEndian.Uint32(subnet.Mask))
+	for _, ip := range []net.IP{start, end} {
+		if !subnet.Contains(ip) || ip.Equal(subnet.IP) || ip.Equal(bcast) {
+			return fmt.Errorf("range address %v is not a host address of %v", ip, subnet)
+		}
+	}
+	if ip2int(end) < ip2int(start) {
+		return fmt.Errorf("range end %v is before start %v", end, start)
+	}
+	if serverIP != nil && ip2int(start) == ip2int(serverIP) && ip2int(end) == ip2int(serverIP) {
+		return fmt.Errorf("range contains only the server address %v", serverIP)
+	}
+	if c.LeaseTime < 0 || (c.LeaseTime > 0 && c.LeaseTime < 60) {
+		return fmt.Errorf("lease time %v should be at least 60 seconds", c.LeaseTime)
+	}
+	if c.DomainName != "" && !domainNameRegexp.MatchString(c.DomainName) {
+		return fmt.Errorf("bad domain name %v", c.DomainName)
+	}
+	for _, d := range c.SearchDomains {
+		if !domainNameRegexp.MatchString(d) {
+			return fmt.Errorf("bad search domain %v", d)
+		}
+	}
+	t, err := c.GetHostnameTemplate()
+	if err != nil {
+		return fmt.Errorf("bad hostname template: %v", err)
+	}
+	if _, err := RenderHostname(t, net.HardwareAddr{0x52, 0x54, 0, 0x12, 0x34, 0x56}); err != nil {
+		return fmt.Errorf("bad hostname template: %v", err)
+	}
+	if c.Router != "" {
+		router, err := parseIPv4(c.Router)
+		if err != nil {
+			return err
+		}
+		if !subnet.Contains(router) {
+			return fmt.Errorf("router %v is not in %v", router, subnet)
+		}
+	}
+	for _, ips := range [][]string{c.DNS, c.NTP} {
+		for _, s := range ips {
+			if _, err := parseIPv4(s); err != nil {
+				return err
+			}
+		}
+	}
+	for _, o := range c.Options {
+		if managedDhcpOptions[o.Code] {
+			return fmt.Errorf("dhcp option %v cannot be overridden", o.Code)
+		}
+		if len(o.Value) > 255 {
+			return fmt.Errorf("dhcp option %v is too long", o.Code)
+		}
+	}
+	return nil
+}
@@ -22,9 +22,23 @@ import (
 
 const (
 	RoleManager = "manager"
-
-	UndiUrl      string = "http://boot.ipxe.org/undionly.kpxe"
-	UndiFilename string = "undionly.kpxe"
+	RoleNode    = "node"
+
+	UndiUrl         string = "https://boot.ipxe.org/undionly.kpxe"
+	UndiFilename    string = "undionly.kpxe"
+	IpxeEfiUrl      string = "https://boot.ipxe.org/ipxe.efi"
+	IpxeEfiFilename string = "ipxe.efi"
+	// ipxe for arm64 uefi has the same name upstream, it is renamed here
+	IpxeArm64EfiUrl      string = "https://boot.ipxe.org/arm64-efi/ipxe.efi"
+	IpxeArm64EfiFilename string = "ipxe-arm64.efi"
+
+	// ipxe binaries and their SHA256SUMS shipped in the initramfs
+	IpxeImageDir string = "/usr/share/k8sinit/ipxe"
+
+	// the management api is served over https, plain http only serves the
+	// paths ipxe boots from
+	HttpPort  = 8000
+	HttpsPort = 8443
 )
 
 var (
@@ -17,40 +17,100 @@ limitations under the License.
 package management
 
 import (
+	"fmt"
 	"github.com/kazimsarikaya/k8sinit/internal/k8sinit"
+	"github.com/kazimsarikaya/k8sinit/internal/k8sinit/audit"
+	"github.com/kazimsarikaya/k8sinit/internal/k8sinit/auth"
+	"github.com/kazimsarikaya/k8sinit/internal/k8sinit/boot"
 	"github.com/kazimsarikaya/k8sinit/internal/k8sinit/network/dhcp"
+	"github.com/kazimsarikaya/k8sinit/internal/k8sinit/network/dns"
 	"github.com/kazimsarikaya/k8sinit/internal/k8sinit/network/http"
+	"github.com/kazimsarikaya/k8sinit/internal/k8sinit/network/nat"
+	"github.com/kazimsarikaya/k8sinit/internal/k8sinit/network/ntp"
 	"github.com/kazimsarikaya/k8sinit/internal/k8sinit/network/tftp"
+	"github.com/kazimsarikaya/k8sinit/internal/k8sinit/pki"
 	klog "k8s.io/klog/v2"
+	"net"
 )
 
 type ManagementServices struct {
 	tftpServer *tftp.NonBlockingTftpSever
 	httpServer *http.NonBlockingHttpServer
 	dhcpServer *dhcp.NonBlockingDhcpServer
+	dnsServer  *dns.NonBlockingDnsServer
+	ntpServer  *ntp.NonBlockingNtpServer
+	natGateway *nat.Gateway
 }
 
 var singletonManagementServices *ManagementServices = nil
 
-func NewOrGetManagementServices(role, poolName, ifname, tftpDir, htdocsDir string) (*ManagementServices, error) {
+func NewOrGetManagementServices(role string, ic *k8sinit.InstallConfig) (*ManagementServices, error) {
 	if singletonManagementServices != nil {
 		return singletonManagementServices, nil
 	}
 	ms := &ManagementServices{}
-	var err error
-	ms.httpServer, err = http.NewNonBlockingHttpSever(htdocsDir)
+	poolName := ""
+	bootDir := ""
+	auditConfig := k8sinit.AuditConfig{}
+	httpConfig := k8sinit.HttpConfig{}
+	if ic != nil {
+		poolName = ic.PoolName
+		bootDir = fmt.Sprintf("/%v/boot", ic.PoolName)
+		auditConfig = ic.Audit
+		httpConfig = ic.Http
+	}
+	boot.NewOrGetFileServer(bootDir, httpConfig.GetMaxBootTransfers(), httpConfig.GetMaxBootQueue())
+	if _, err := audit.NewOrGetLogger(audit.Dir(poolName), auditConfig.MaxSize, auditConfig.MaxFiles); err != nil {
+		return nil, err
+	}
+	if _, err := auth.NewOrGetAuthenticator(poolName); err != nil {
+		return nil, err
+	}
+	certs, err := pki.NewOrGetPki(pki.Dir(poolName))
+	if err != nil {
+		return nil, err
+	}
+	ms.httpServer, err = http.NewNonBlockingHttpSever(ic, certs)
 	if err != nil {
 		return nil, err
 	}
 	if role == k8sinit.RoleManager {
-		ms.tftpServer, err = tftp.NewNonBlockingTftpSever(tftpDir)
+		ms.tftpServer, err = tftp.NewNonBlockingTftpSever(ic)
 		if err != nil && err != k8sinit.K8SInitNotInstalledError {
 			return nil, err
 		}
-		ms.dhcpServer, err = dhcp.NewNonBlockingDhcpSever(poolName, ifname)
+		ms.ntpServer, err = ntp.NewNonBlockingNtpServer()
+		if err != nil {
+			return nil, err
+		}
+		ms.dhcpServer, err = dhcp.NewNonBlockingDhcpSever(ic)
 		if err != nil && err != k8sinit.K8SInitNotInstalledError {
 			return nil, err
 		}
+		if ms.dhcpServer != nil {
+			local := ms.dhcpServer.LocalScope()
+			ms.dnsServer, err = dns.NewNonBlockingDnsServer(dns.DnsConf{
+				Domain:   local.DomainName,
+				Subnet:   local.Subnet,
+				Resolver: ms.dhcpServer.Leases(),
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+		if ic != nil && !ic.Nat.Disabled {
+			_, subnet, err := net.ParseCIDR(ic.InternalNetworkIPAndPrefix)
+			if err != nil {
+				return nil, err
+			}
+			ms.natGateway, err = nat.NewGateway(nat.GatewayConf{Source: subnet, OutInterface: ic.ExternalNetwork})
+			if err != nil {
+				return nil, err
+			}
+		}
+		if _, err = boot.NewOrGetProfiles(poolName); err != nil && err != k8sinit.K8SInitNotInstalledError {
+			return nil, err
+		}
 	}
 	singletonManagementServices = ms
 	return ms, nil
@@ -67,6 +127,23 @@ func (ms *ManagementServices) StopAll() {
 		klog.Flush()
 		ms.dhcpServer.Stop()
 	}
+	if ms.dnsServer != nil {
+		klog.Infof("stopping dns server")
+		klog.Flush()
+		ms.dnsServer.Stop()
+	}
+	if ms.ntpServer != nil {
+		klog.Infof("stopping ntp server")
+		klog.Flush()
+		ms.ntpServer.Stop()
+	}
+	if ms.natGateway != nil {
+		klog.Infof("removing nat rules")
+		klog.Flush()
+		if err := ms.natGateway.Disable(); err != nil {
+			klog.V(0).Error(err, "cannot remove nat rules")
+		}
+	}
 	if ms.httpServer != nil {
 		klog.Infof("stopping http server")
 		klog.Flush()
@@ -75,13 +152,41 @@ func (ms *ManagementServices) StopAll() {
 }
 
 func (ms *ManagementServices) StartTftp(ipaddr string) {
-	ms.tftpServer.Start(ipaddr)
+	if err := ms.tftpServer.Start(ipaddr); err != nil {
+		klog.V(0).Error(err, "cannot start tftp server")
+	}
 }
 
 func (ms *ManagementServices) StartHttp() {
-	ms.httpServer.Start()
+	if err := ms.httpServer.Start(); err != nil {
+		klog.V(0).Error(err, "cannot start http server")
+	}
 }
 
 func (ms *ManagementServices) StartDhcp() {
 	ms.dhcpServer.Start()
 }
+
+func (ms *ManagementServices) StartDns(ipaddr string) {
+	if ms.dnsServer == nil {
+		return
+	}
+	if err := ms.dnsServer.Start(ipaddr); err != nil {
+		klog.V(0).Error(err, "cannot start dns server")
+	}
+}
+
+func (ms *ManagementServices) StartNtp(ipaddr string) {
+	if err := ms.ntpServer.Start(ipaddr); err != nil {
+		klog.V(0).Error(err, "cannot start ntp server")
+	}
+}
+
+func (ms *ManagementServices) StartNat() {
+	if ms.natGateway == nil {
+		return
+	}
+	if err := ms.natGateway.Enable(); err != nil {
+		klog.V(0).Error(err, "cannot enable nat")
+	}
+}
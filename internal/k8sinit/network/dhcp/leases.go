@@ -0,0 +1,496 @@
+/*
+Copyright 2020 Kazım SARIKAYA
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dhcp
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/kazimsarikaya/k8sinit/internal/k8sinit"
+	"github.com/kazimsarikaya/k8sinit/internal/k8sinit/network"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	klog "k8s.io/klog/v2"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type LeaseState string
+
+const (
+	LeaseStateOffered  LeaseState = "offered"
+	LeaseStateBound    LeaseState = "bound"
+	LeaseStateReleased LeaseState = "released"
+	LeaseStateDeclined LeaseState = "declined"
+
+	offerHoldTime   = 2 * time.Minute
+	declineHoldTime = time.Hour
+
+	// leases are remembered for this long after they end, so returning
+	// clients get their address back
+	leaseGraceTime = 7 * 24 * time.Hour
+	pruneInterval  = time.Minute
+)
+
+var (
+	PoolExhaustedError    = errors.New("dhcp pool exhausted")
+	AddressNotInPoolError = errors.New("address is not in dhcp pool")
+	AddressInUseError     = errors.New("address is leased to another client")
+	LeaseNotFoundError    = errors.New("lease not found")
+)
+
+// Lease is the address of a client. Hostname is the name assigned by the
+// server, ClientHostname the one the client sent.
+type Lease struct {
+	MAC            string     `json:"mac"`
+	IP             net.IP     `json:"ip"`
+	Hostname       string     `json:"hostname,omitempty"`
+	ClientHostname string     `json:"clienthostname,omitempty"`
+	UserClass      []string   `json:"userclass,omitempty"`
+	Scope          string     `json:"scope,omitempty"`
+	CircuitID      string     `json:"circuitid,omitempty"`
+	RemoteID       string     `json:"remoteid,omitempty"`
+	State          LeaseState `json:"state"`
+	FirstSeen      time.Time  `json:"firstseen"`
+	Expiry         time.Time  `json:"expiry"`
+}
+
+func (l *Lease) IsActive(now time.Time) bool {
+	return now.Before(l.Expiry)
+}
+
+type LeaseDB struct {
+	file    string
+	statics *StaticHosts
+	mu      sync.Mutex
+	leases  map[uint32]*Lease
+	pruned  time.Time
+}
+
+func NewLeaseDB(file string, statics *StaticHosts) (*LeaseDB, error) {
+	db := &LeaseDB{
+		file:    file,
+		statics: statics,
+		leases:  make(map[uint32]*Lease),
+	}
+	if err := db.load(); err != nil {
+		return nil, err
+	}
+	statics.leases = db
+	return db, nil
+}
+
+func (db *LeaseDB) load() error {
+	data, err := ioutil.ReadFile(db.file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return errors.Wrapf(err, "cannot read leases file %v", db.file)
+	}
+	var leases []*Lease
+	if err := json.Unmarshal(data, &leases); err != nil {
+		return errors.Wrapf(err, "cannot decode leases file %v", db.file)
+	}
+	for _, l := range leases {
+		if l.IP.To4() == nil {
+			continue
+		}
+		db.leases[network.Ip2Int(l.IP.To4())] = l
+	}
+	db.prune(time.Now())
+	return nil
+}
+
+// prune should be called with db.mu held. It forgets offers nobody requested
+// and leases which ended longer than leaseGraceTime ago.
+func (db *LeaseDB) prune(now time.Time) {
+	for ip, l := range db.leases {
+		if l.IsActive(now) {
+			continue
+		}
+		if l.State == LeaseStateOffered || now.Sub(l.Expiry) > leaseGraceTime {
+			delete(db.leases, ip)
+		}
+	}
+	db.pruned = now
+}
+
+// save should be called with db.mu held. It writes to a temp file and renames
+// it so a power loss cannot leave a truncated leases file behind. Old
+// records are pruned first.
+func (db *LeaseDB) save() error {
+	if now := time.Now(); now.Sub(db.pruned) > pruneInterval {
+		db.prune(now)
+	}
+	leases := make([]*Lease, 0, len(db.leases))
+	for _, l := range db.leases {
+		leases = append(leases, l)
+	}
+	sort.Slice(leases, func(i, j int) bool {
+		return network.Ip2Int(leases[i].IP.To4()) < network.Ip2Int(leases[j].IP.To4())
+	})
+	data, err := json.MarshalIndent(leases, "", "  ")
+	if err != nil {
+		return errors.Wrapf(err, "cannot encode leases")
+	}
+	tmp := db.file + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return errors.Wrapf(err, "cannot write leases file %v", tmp)
+	}
+	if err := os.Rename(tmp, db.file); err != nil {
+		return errors.Wrapf(err, "cannot replace leases file %v", db.file)
+	}
+	return nil
+}
+
+// findByMAC returns the lease of mac, skipping addresses it declined.
+func (db *LeaseDB) findByMAC(mac string) *Lease {
+	for _, l := range db.leases {
+		if l.MAC == mac && l.State != LeaseStateDeclined {
+			return l
+		}
+	}
+	return nil
+}
+
+// reservedIP returns the address reserved for mac if it belongs to the scope.
+// A reservation on another subnet is useless for the client here.
+func (db *LeaseDB) reservedIP(sc *Scope, mac string) net.IP {
+	if rip := db.statics.reservedIP(mac); rip != nil && sc.Assignable(rip) {
+		return rip
+	}
+	return nil
+}
+
+// hostname returns the name of the client, the reserved one if any, else the
+// one generated by the template of the scope.
+func (db *LeaseDB) hostname(sc *Scope, mac net.HardwareAddr) string {
+	if hn := db.statics.reservedHostname(mac.String()); hn != "" {
+		return hn
+	}
+	if sc.hostnameTemplate == nil {
+		return ""
+	}
+	hn, err := k8sinit.RenderHostname(sc.hostnameTemplate, mac)
+	if err != nil {
+		klog.V(0).Error(err, "cannot generate hostname", "mac", mac, "scope", sc.Name)
+		return ""
+	}
+	return hn
+}
+
+// isFree should be called with db.mu held. A reserved address is free only
+// for its owner and only while no other client has an active lease on it.
+func (db *LeaseDB) isFree(sc *Scope, ip uint32, mac string, now time.Time) bool {
+	if rip := db.reservedIP(sc, mac); rip != nil {
+		if network.Ip2Int(rip) != ip {
+			return false
+		}
+	} else if !sc.inPool(ip) || db.statics.isReserved(network.Int2Ip(ip)) {
+		return false
+	}
+	l, ok := db.leases[ip]
+	return !ok || !l.IsActive(now) || (l.MAC == mac && l.State != LeaseStateDeclined)
+}
+
+// activeHolder should be called with db.mu held. It returns the mac address
+// of the client other than mac having an active lease on ip, if any.
+func (db *LeaseDB) activeHolder(ip net.IP, mac string, now time.Time) string {
+	l, ok := db.leases[network.Ip2Int(ip.To4())]
+	if !ok || l.MAC == mac || !l.IsActive(now) {
+		return ""
+	}
+	return l.MAC
+}
+
+// allocate should be called with db.mu held. It prefers the reserved address
+// of the client, then the address the client had before, then the requested
+// one, then never used addresses and at last the address whose lease expired
+// earliest. A client whose reserved address is still leased to another one
+// gets nothing until that lease ends.
+func (db *LeaseDB) allocate(sc *Scope, mac string, requested net.IP, now time.Time) (uint32, error) {
+	if rip := db.reservedIP(sc, mac); rip != nil {
+		if !db.isFree(sc, network.Ip2Int(rip), mac, now) {
+			return 0, AddressInUseError
+		}
+		return network.Ip2Int(rip), nil
+	}
+	if l := db.findByMAC(mac); l != nil && db.isFree(sc, network.Ip2Int(l.IP.To4()), mac, now) {
+		return network.Ip2Int(l.IP.To4()), nil
+	}
+	if requested != nil && requested.To4() != nil && !requested.To4().Equal(net.IPv4zero) {
+		rip := network.Ip2Int(requested.To4())
+		if db.isFree(sc, rip, mac, now) {
+			return rip, nil
+		}
+	}
+	var oldest *Lease
+	for i := 0; i < sc.MaxHost; i++ {
+		ip := sc.PoolStart + uint32(i)
+		if !sc.inPool(ip) || db.statics.isReserved(network.Int2Ip(ip)) {
+			continue
+		}
+		l, ok := db.leases[ip]
+		if !ok {
+			return ip, nil
+		}
+		if !l.IsActive(now) && (oldest == nil || l.Expiry.Before(oldest.Expiry)) {
+			oldest = l
+		}
+	}
+	if oldest != nil {
+		return network.Ip2Int(oldest.IP.To4()), nil
+	}
+	return 0, PoolExhaustedError
+}
+
+// update should be called with db.mu held. It moves the lease of the client
+// to ip, dropping any record the client or an expired client had before.
+func (db *LeaseDB) update(sc *Scope, m *dhcpv4.DHCPv4, ip uint32, state LeaseState, d time.Duration, now time.Time) *Lease {
+	mac := m.ClientHWAddr.String()
+	l := db.findByMAC(mac)
+	if l != nil && network.Ip2Int(l.IP.To4()) != ip {
+		delete(db.leases, network.Ip2Int(l.IP.To4()))
+		l.IP = network.Int2Ip(ip)
+	}
+	if l == nil {
+		l = &Lease{
+			MAC:       mac,
+			IP:        network.Int2Ip(ip),
+			FirstSeen: now,
+		}
+	}
+	db.leases[ip] = l
+	if hn := m.HostName(); hn != "" {
+		l.ClientHostname = hn
+	}
+	l.Hostname = db.hostname(sc, m.ClientHWAddr)
+	if uc := m.UserClass(); len(uc) > 0 {
+		l.UserClass = uc
+	}
+	l.Scope = sc.Name
+	l.CircuitID, l.RemoteID = "", ""
+	if rai := m.RelayAgentInfo(); rai != nil {
+		l.CircuitID = relayAgentValue(rai.Get(dhcpv4.AgentCircuitIDSubOption))
+		l.RemoteID = relayAgentValue(rai.Get(dhcpv4.AgentRemoteIDSubOption))
+	}
+	expiry := now.Add(d)
+	if state == LeaseStateOffered && l.State == LeaseStateBound && l.Expiry.After(expiry) {
+		// a rediscovering client keeps its bound lease until it requests again
+		expiry = l.Expiry
+		state = LeaseStateBound
+	}
+	l.State = state
+	l.Expiry = expiry
+	return l
+}
+
+// Offer reserves an address for the client for a short time, long enough
+// for the client to request it. Offers are kept in memory only, a discover
+// storm must not turn into disk writes.
+func (db *LeaseDB) Offer(sc *Scope, m *dhcpv4.DHCPv4) (Lease, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	now := time.Now()
+	if now.Sub(db.pruned) > pruneInterval {
+		db.prune(now)
+	}
+	ip, err := db.allocate(sc, m.ClientHWAddr.String(), m.RequestedIPAddress(), now)
+	if err != nil {
+		return Lease{}, err
+	}
+	l := db.update(sc, m, ip, LeaseStateOffered, offerHoldTime, now)
+	return *l, nil
+}
+
+// Bind leases ip to the client for the lease time of the scope. It is used
+// for both new leases and renewals.
+func (db *LeaseDB) Bind(sc *Scope, m *dhcpv4.DHCPv4, ip net.IP) (Lease, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	now := time.Now()
+	if ip == nil || ip.To4() == nil {
+		return Lease{}, AddressNotInPoolError
+	}
+	iip := network.Ip2Int(ip.To4())
+	mac := m.ClientHWAddr.String()
+	rip := db.reservedIP(sc, mac)
+	if rip != nil && network.Ip2Int(rip) != iip {
+		return Lease{}, AddressNotInPoolError
+	}
+	if rip == nil && !sc.inPool(iip) {
+		return Lease{}, AddressNotInPoolError
+	}
+	if !db.isFree(sc, iip, mac, now) {
+		return Lease{}, AddressInUseError
+	}
+	l := db.update(sc, m, iip, LeaseStateBound, sc.LeaseTime, now)
+	if err := db.save(); err != nil {
+		return Lease{}, err
+	}
+	return *l, nil
+}
+
+func (db *LeaseDB) List() []Lease {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	result := make([]Lease, 0, len(db.leases))
+	for _, l := range db.leases {
+		result = append(result, *l)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return network.Ip2Int(result[i].IP.To4()) < network.Ip2Int(result[j].IP.To4())
+	})
+	return result
+}
+
+func (db *LeaseDB) Get(mac string) (Lease, error) {
+	hw, err := net.ParseMAC(mac)
+	if err != nil {
+		return Lease{}, LeaseNotFoundError
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	l := db.findByMAC(hw.String())
+	if l == nil {
+		return Lease{}, LeaseNotFoundError
+	}
+	return *l, nil
+}
+
+// Revoke forgets the lease of mac so its address can be given to another
+// client. The client itself notices it when it tries to renew.
+func (db *LeaseDB) Revoke(mac string) error {
+	hw, err := net.ParseMAC(mac)
+	if err != nil {
+		return LeaseNotFoundError
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	l := db.findByMAC(hw.String())
+	if l == nil {
+		return LeaseNotFoundError
+	}
+	ip := network.Ip2Int(l.IP.To4())
+	delete(db.leases, ip)
+	if err := db.save(); err != nil {
+		db.leases[ip] = l
+		return err
+	}
+	return nil
+}
+
+// LookupName returns the address of the client named name. Bound leases and
+// reservations are searched, reservations win.
+func (db *LeaseDB) LookupName(name string) net.IP {
+	for _, h := range db.statics.List() {
+		if h.Hostname != "" && strings.EqualFold(h.Hostname, name) {
+			return h.IP
+		}
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	now := time.Now()
+	for _, l := range db.leases {
+		if l.State == LeaseStateBound && l.IsActive(now) && strings.EqualFold(l.Hostname, name) {
+			return l.IP
+		}
+	}
+	return nil
+}
+
+// LookupAddr returns the name of the client having ip, or an empty string.
+func (db *LeaseDB) LookupAddr(ip net.IP) string {
+	for _, h := range db.statics.List() {
+		if h.Hostname != "" && h.IP.Equal(ip) {
+			return h.Hostname
+		}
+	}
+	if ip.To4() == nil {
+		return ""
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	l, ok := db.leases[network.Ip2Int(ip.To4())]
+	if !ok || l.State != LeaseStateBound || !l.IsActive(time.Now()) {
+		return ""
+	}
+	return l.Hostname
+}
+
+// CancelOffer drops the pending offer of mac, the client selected another
+// server. Bound leases are kept.
+func (db *LeaseDB) CancelOffer(mac string) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	l := db.findByMAC(mac)
+	if l == nil || l.State != LeaseStateOffered {
+		return
+	}
+	l.Expiry = time.Now()
+}
+
+// Release ends the lease of mac on ip now. The record is kept, so the client
+// gets the same address when it comes back.
+func (db *LeaseDB) Release(mac string, ip net.IP) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	l := db.findByMAC(mac)
+	if l == nil || !l.IP.Equal(ip) {
+		return LeaseNotFoundError
+	}
+	l.State = LeaseStateReleased
+	l.Expiry = time.Now()
+	return db.save()
+}
+
+// Decline quarantines ip which the client found in use by someone else.
+// Nobody gets the address until the quarantine ends.
+func (db *LeaseDB) Decline(mac string, ip net.IP) error {
+	if ip == nil || ip.To4() == nil {
+		return AddressNotInPoolError
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	iip := network.Ip2Int(ip.To4())
+	l, ok := db.leases[iip]
+	if !ok || l.MAC != mac {
+		return LeaseNotFoundError
+	}
+	l.State = LeaseStateDeclined
+	l.Expiry = time.Now().Add(declineHoldTime)
+	return db.save()
+}
+
+// relayAgentValue renders an option 82 sub-option, printable ids are kept as
+// they are and binary ones are hex encoded.
+func relayAgentValue(b []byte) string {
+	if len(b) == 0 {
+		return ""
+	}
+	for _, c := range b {
+		if c < 0x20 || c > 0x7e {
+			return fmt.Sprintf("0x%x", b)
+		}
+	}
+	return string(b)
+}
@@ -0,0 +1,230 @@
+/*
+Copyright 2020 Kazım SARIKAYA
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dhcp
+
+import (
+	"encoding/json"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/kazimsarikaya/k8sinit/internal/k8sinit"
+	"github.com/kazimsarikaya/k8sinit/internal/k8sinit/network"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const (
+	macA     = "aa:bb:cc:dd:ee:01"
+	macB     = "aa:bb:cc:dd:ee:02"
+	macOwner = "aa:bb:cc:dd:ee:03"
+)
+
+var serverIP = net.ParseIP("10.0.0.1").To4()
+
+// newTestScope has the pool 10.0.0.10-10.0.0.12.
+func newTestScope(t *testing.T) *Scope {
+	sc, err := NewScope(ScopeConfig{
+		Name:       LocalScopeName,
+		Subnet:     "10.0.0.0/24",
+		DhcpConfig: k8sinit.DhcpConfig{RangeStart: "10.0.0.10", RangeEnd: "10.0.0.12"},
+	}, serverIP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sc
+}
+
+// newTestDB reserves 10.0.0.11 for macOwner and loads leases.
+func newTestDB(t *testing.T, sc *Scope, leases []*Lease) *LeaseDB {
+	dir, err := ioutil.TempDir("", "dhcp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	statics := []StaticHost{{MAC: "AA:BB:CC:DD:EE:03", IP: net.ParseIP("10.0.0.11")}}
+	writeJSON(t, filepath.Join(dir, "static.json"), statics)
+	writeJSON(t, filepath.Join(dir, "leases.json"), leases)
+	sh, err := NewStaticHosts(filepath.Join(dir, "static.json"), []*Scope{sc})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := NewLeaseDB(filepath.Join(dir, "leases.json"), sh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func writeJSON(t *testing.T, file string, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(file, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func lease(mac, ip string, state LeaseState, expiry time.Time) *Lease {
+	return &Lease{MAC: mac, IP: net.ParseIP(ip).To4(), State: state, Expiry: expiry}
+}
+
+func ip(s string) uint32 {
+	return network.Ip2Int(net.ParseIP(s).To4())
+}
+
+func discover(t *testing.T, mac string) *dhcpv4.DHCPv4 {
+	hw, err := net.ParseMAC(mac)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := dhcpv4.NewDiscovery(hw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestIsFree(t *testing.T) {
+	now := time.Now()
+	active, expired := now.Add(time.Hour), now.Add(-time.Hour)
+	tests := []struct {
+		name   string
+		leases []*Lease
+		ip     string
+		mac    string
+		free   bool
+	}{
+		{"unleased", nil, "10.0.0.10", macA, true},
+		{"outside pool", nil, "10.0.0.50", macA, false},
+		{"reserved for another", nil, "10.0.0.11", macA, false},
+		{"reserved for owner", nil, "10.0.0.11", macOwner, true},
+		{"owner outside reservation", nil, "10.0.0.10", macOwner, false},
+		{"reserved with active lease of another", []*Lease{lease(macA, "10.0.0.11", LeaseStateBound, active)}, "10.0.0.11", macOwner, false},
+		{"active lease of another", []*Lease{lease(macB, "10.0.0.10", LeaseStateBound, active)}, "10.0.0.10", macA, false},
+		{"expired lease of another", []*Lease{lease(macB, "10.0.0.10", LeaseStateBound, expired)}, "10.0.0.10", macA, true},
+		{"own active lease", []*Lease{lease(macA, "10.0.0.10", LeaseStateBound, active)}, "10.0.0.10", macA, true},
+		{"own declined address", []*Lease{lease(macA, "10.0.0.10", LeaseStateDeclined, active)}, "10.0.0.10", macA, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sc := newTestScope(t)
+			db := newTestDB(t, sc, tt.leases)
+			if free := db.isFree(sc, ip(tt.ip), tt.mac, now); free != tt.free {
+				t.Errorf("isFree(%v, %v) = %v, want %v", tt.ip, tt.mac, free, tt.free)
+			}
+		})
+	}
+}
+
+func TestAllocate(t *testing.T) {
+	now := time.Now()
+	active := now.Add(time.Hour)
+	tests := []struct {
+		name      string
+		leases    []*Lease
+		mac       string
+		requested string
+		want      string
+		err       error
+	}{
+		{"first address", nil, macA, "", "10.0.0.10", nil},
+		{"reservation", nil, macOwner, "10.0.0.12", "10.0.0.11", nil},
+		{"reservation leased to another", []*Lease{lease(macA, "10.0.0.11", LeaseStateBound, active)}, macOwner, "", "", AddressInUseError},
+		{"previous address", []*Lease{lease(macA, "10.0.0.12", LeaseStateReleased, now.Add(-time.Hour))}, macA, "10.0.0.10", "10.0.0.12", nil},
+		{"requested address", nil, macA, "10.0.0.12", "10.0.0.12", nil},
+		{"requested reserved address", nil, macA, "10.0.0.11", "10.0.0.10", nil},
+		{"requested leased address", []*Lease{lease(macB, "10.0.0.12", LeaseStateBound, active)}, macA, "10.0.0.12", "10.0.0.10", nil},
+		{"declined address skipped", []*Lease{lease(macB, "10.0.0.10", LeaseStateDeclined, active)}, macA, "", "10.0.0.12", nil},
+		{"earliest expired reused", []*Lease{
+			lease(macB, "10.0.0.10", LeaseStateBound, now.Add(-time.Hour)),
+			lease(macOwner, "10.0.0.12", LeaseStateBound, now.Add(-2*time.Hour)),
+		}, macA, "", "10.0.0.12", nil},
+		{"exhausted", []*Lease{
+			lease(macB, "10.0.0.10", LeaseStateBound, active),
+			lease(macOwner, "10.0.0.12", LeaseStateBound, active),
+		}, macA, "", "", PoolExhaustedError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sc := newTestScope(t)
+			db := newTestDB(t, sc, tt.leases)
+			got, err := db.allocate(sc, tt.mac, net.ParseIP(tt.requested), now)
+			if err != tt.err {
+				t.Fatalf("allocate error %v, want %v", err, tt.err)
+			}
+			if err == nil && got != ip(tt.want) {
+				t.Errorf("allocate = %v, want %v", network.Int2Ip(got), tt.want)
+			}
+		})
+	}
+}
+
+func TestLeaseLifecycle(t *testing.T) {
+	sc := newTestScope(t)
+	db := newTestDB(t, sc, nil)
+	ma, mb := discover(t, macA), discover(t, macB)
+
+	offer, err := db.Offer(sc, ma)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, err := ioutil.ReadFile(db.file); err != nil || string(data) != "null" {
+		t.Errorf("offer was saved: %s %v", data, err)
+	}
+	bound, err := db.Bind(sc, ma, offer.IP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bound.State != LeaseStateBound || !bound.IP.Equal(offer.IP) {
+		t.Fatalf("bound lease %+v", bound)
+	}
+	if _, err := db.Bind(sc, mb, offer.IP); err != AddressInUseError {
+		t.Errorf("bind of a leased address: %v, want %v", err, AddressInUseError)
+	}
+
+	if err := db.Decline(macA, offer.IP); err != nil {
+		t.Fatal(err)
+	}
+	if l, err := db.Offer(sc, mb); err != nil || l.IP.Equal(offer.IP) {
+		t.Errorf("declined address offered: %v %v", l.IP, err)
+	}
+	if _, err := db.Offer(sc, ma); err != PoolExhaustedError {
+		t.Errorf("offer with the declined address held: %v, want %v", err, PoolExhaustedError)
+	}
+}
+
+func TestPruneOnLoad(t *testing.T) {
+	now := time.Now()
+	sc := newTestScope(t)
+	db := newTestDB(t, sc, []*Lease{
+		lease(macA, "10.0.0.10", LeaseStateReleased, now.Add(-leaseGraceTime-time.Hour)),
+		lease(macB, "10.0.0.12", LeaseStateReleased, now.Add(-time.Hour)),
+		lease(macOwner, "10.0.0.11", LeaseStateOffered, now.Add(-time.Minute)),
+	})
+	if _, err := db.Get(macA); err != LeaseNotFoundError {
+		t.Errorf("lease ended before the grace time kept: %v", err)
+	}
+	if _, err := db.Get(macB); err != nil {
+		t.Errorf("lease ended in the grace time dropped: %v", err)
+	}
+	if _, err := db.Get(macOwner); err != LeaseNotFoundError {
+		t.Errorf("expired offer kept: %v", err)
+	}
+}
@@ -0,0 +1,185 @@
+/*
+Copyright 2020 Kazım SARIKAYA
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dhcp
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/kazimsarikaya/k8sinit/internal/k8sinit"
+	"github.com/kazimsarikaya/k8sinit/internal/k8sinit/network"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"text/template"
+	"time"
+)
+
+const LocalScopeName = "local"
+
+// ScopeConfig is the json form of a scope. Scopes other than the local one
+// serve clients behind dhcp relays and are selected by giaddr.
+type ScopeConfig struct {
+	Name   string `json:"name"`
+	Subnet string `json:"subnet"`
+	k8sinit.DhcpConfig
+}
+
+type Scope struct {
+	Name             string
+	Subnet           *net.IPNet
+	PoolStart        uint32
+	MaxHost          int
+	LeaseTime        time.Duration
+	DomainName       string
+	SearchDomains    []string
+	Router           []net.IP
+	DNS              []net.IP
+	NTP              []net.IP
+	Options          []dhcpv4.Option
+	excludes         []net.IP
+	hostnameTemplate *template.Template
+}
+
+func parseIPs(ips []string) ([]net.IP, error) {
+	var result []net.IP
+	for _, s := range ips {
+		ip := net.ParseIP(s).To4()
+		if ip == nil {
+			return nil, fmt.Errorf("bad ipv4 address %v", s)
+		}
+		result = append(result, ip)
+	}
+	return result, nil
+}
+
+// NewScope builds a scope from its config. serverIP is used for dns and ntp
+// when the config does not set them, and as router when it is on the subnet.
+func NewScope(cfg ScopeConfig, serverIP net.IP) (*Scope, error) {
+	_, subnet, err := net.ParseCIDR(cfg.Subnet)
+	if err != nil || subnet.IP.To4() == nil {
+		return nil, fmt.Errorf("scope %v: bad subnet %v", cfg.Name, cfg.Subnet)
+	}
+	var localIP net.IP
+	if subnet.Contains(serverIP) {
+		localIP = serverIP
+	}
+	if err := cfg.Validate(subnet, localIP); err != nil {
+		return nil, errors.Wrapf(err, "scope %v", cfg.Name)
+	}
+	start, end, _ := cfg.Range(subnet)
+	t, _ := cfg.GetHostnameTemplate()
+	sc := &Scope{
+		Name:             cfg.Name,
+		Subnet:           subnet,
+		PoolStart:        network.Ip2Int(start),
+		MaxHost:          int(network.Ip2Int(end)-network.Ip2Int(start)) + 1,
+		LeaseTime:        cfg.GetLeaseTime(),
+		DomainName:       cfg.DomainName,
+		SearchDomains:    cfg.SearchDomains,
+		DNS:              []net.IP{serverIP},
+		NTP:              []net.IP{serverIP},
+		hostnameTemplate: t,
+	}
+	if len(sc.SearchDomains) == 0 && sc.DomainName != "" {
+		sc.SearchDomains = []string{sc.DomainName}
+	}
+	if localIP != nil {
+		sc.Router = []net.IP{localIP}
+		sc.excludes = append(sc.excludes, localIP)
+	}
+	if cfg.Router != "" {
+		sc.Router, _ = parseIPs([]string{cfg.Router})
+		sc.excludes = append(sc.excludes, sc.Router...)
+	}
+	if len(cfg.DNS) > 0 {
+		sc.DNS, _ = parseIPs(cfg.DNS)
+	}
+	if len(cfg.NTP) > 0 {
+		sc.NTP, _ = parseIPs(cfg.NTP)
+	}
+	for _, o := range cfg.Options {
+		sc.Options = append(sc.Options, dhcpv4.OptGeneric(dhcpv4.GenericOptionCode(o.Code), []byte(o.Value)))
+	}
+	return sc, nil
+}
+
+// LoadScopes reads the relay scopes from file. A missing file means there
+// are no relay scopes. The subnets of the scopes may not overlap each other
+// or the one of local, giaddr must select one scope.
+func LoadScopes(file string, serverIP net.IP, local *Scope) ([]*Scope, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, errors.Wrapf(err, "cannot read scopes file %v", file)
+	}
+	var cfgs []ScopeConfig
+	if err := json.Unmarshal(data, &cfgs); err != nil {
+		return nil, errors.Wrapf(err, "cannot decode scopes file %v", file)
+	}
+	var result []*Scope
+	for _, cfg := range cfgs {
+		if cfg.Name == "" || cfg.Name == LocalScopeName {
+			return nil, fmt.Errorf("scope %v: name is empty or reserved", cfg.Name)
+		}
+		sc, err := NewScope(cfg, serverIP)
+		if err != nil {
+			return nil, err
+		}
+		for _, o := range append([]*Scope{local}, result...) {
+			if o != nil && o.overlaps(sc) {
+				return nil, errors.Errorf("scope %v subnet %v overlaps scope %v subnet %v", sc.Name, sc.Subnet, o.Name, o.Subnet)
+			}
+		}
+		result = append(result, sc)
+	}
+	return result, nil
+}
+
+func (sc *Scope) overlaps(o *Scope) bool {
+	return sc.Subnet.Contains(o.Subnet.IP) || o.Subnet.Contains(sc.Subnet.IP)
+}
+
+func (sc *Scope) Broadcast() net.IP {
+	netaddr := network.Ip2Int(sc.Subnet.IP.To4())
+	ones, bits := sc.Subnet.Mask.Size()
+	return network.Int2Ip(netaddr | (1<<uint(bits-ones) - 1))
+}
+
+// Assignable reports whether ip can be given to a client of the scope. It
+// does not check the pool range.
+func (sc *Scope) Assignable(ip net.IP) bool {
+	if !sc.Subnet.Contains(ip) || ip.Equal(sc.Subnet.IP) || ip.Equal(sc.Broadcast()) {
+		return false
+	}
+	for _, ex := range sc.excludes {
+		if ex.Equal(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+func (sc *Scope) inPool(ip uint32) bool {
+	if ip < sc.PoolStart || ip >= sc.PoolStart+uint32(sc.MaxHost) {
+		return false
+	}
+	return sc.Assignable(network.Int2Ip(ip))
+}
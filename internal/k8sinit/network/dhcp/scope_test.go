@@ -0,0 +1,115 @@
+/*
+Copyright 2020 Kazım SARIKAYA
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dhcp
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func newRelayScope(t *testing.T, name, subnet string) *Scope {
+	sc, err := NewScope(ScopeConfig{Name: name, Subnet: subnet}, serverIP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sc
+}
+
+func TestSelectScope(t *testing.T) {
+	local := newTestScope(t)
+	relay1 := newRelayScope(t, "relay1", "10.1.0.0/24")
+	relay2 := newRelayScope(t, "relay2", "10.2.0.0/16")
+	s := &NonBlockingDhcpServer{scopes: []*Scope{local, relay1, relay2}}
+	tests := []struct {
+		name   string
+		giaddr string
+		want   *Scope
+	}{
+		{"not relayed", "", local},
+		{"relayed", "10.1.0.1", relay1},
+		{"relayed to bigger subnet", "10.2.5.1", relay2},
+		{"unknown relay", "10.9.0.1", nil},
+		{"relayed from local subnet", "10.0.0.5", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := discover(t, macA)
+			if tt.giaddr != "" {
+				m.GatewayIPAddr = net.ParseIP(tt.giaddr).To4()
+			}
+			if got := s.selectScope(m); got != tt.want {
+				t.Errorf("selectScope(%v) = %v, want %v", tt.giaddr, scopeName(got), scopeName(tt.want))
+			}
+		})
+	}
+}
+
+func scopeName(sc *Scope) string {
+	if sc == nil {
+		return "<nil>"
+	}
+	return sc.Name
+}
+
+func TestLoadScopes(t *testing.T) {
+	tests := []struct {
+		name    string
+		scopes  []ScopeConfig
+		count   int
+		overlap []string
+	}{
+		{"missing file", nil, 0, nil},
+		{"disjoint", []ScopeConfig{{Name: "a", Subnet: "10.1.0.0/24"}, {Name: "b", Subnet: "10.2.0.0/24"}}, 2, nil},
+		{"overlapping relays", []ScopeConfig{{Name: "a", Subnet: "10.1.0.0/24"}, {Name: "b", Subnet: "10.1.0.0/16"}}, 0, []string{"a", "b"}},
+		{"overlapping local", []ScopeConfig{{Name: "a", Subnet: "10.0.0.128/25"}}, 0, []string{"a", LocalScopeName}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "dhcp")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			file := filepath.Join(dir, "scopes.json")
+			if tt.scopes != nil {
+				writeJSON(t, file, tt.scopes)
+			}
+			scopes, err := LoadScopes(file, serverIP, newTestScope(t))
+			if tt.overlap != nil {
+				if err == nil {
+					t.Fatalf("overlapping scopes loaded")
+				}
+				for _, name := range tt.overlap {
+					if !strings.Contains(err.Error(), "scope "+name+" ") {
+						t.Errorf("error %q does not name scope %v", err, name)
+					}
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(scopes) != tt.count {
+				t.Errorf("loaded %v scopes, want %v", len(scopes), tt.count)
+			}
+		})
+	}
+}
@@ -20,11 +20,14 @@ import (
 	"fmt"
 	"github.com/insomniacslk/dhcp/dhcpv4"
 	"github.com/insomniacslk/dhcp/dhcpv4/server4"
+	"github.com/insomniacslk/dhcp/iana"
+	"github.com/insomniacslk/dhcp/rfc1035label"
 	"github.com/kazimsarikaya/k8sinit/internal/k8sinit"
 	"github.com/kazimsarikaya/k8sinit/internal/k8sinit/network"
 	"github.com/pkg/errors"
 	klog "k8s.io/klog/v2"
 	"net"
+	"strings"
 	"sync"
 	"time"
 )
@@ -36,20 +39,31 @@ type DhcpConf struct {
 	Mask            net.IPMask
 	PoolStart       uint32
 	MaxHost         int
+	LeaseTime       time.Duration
 	StaticHostsFile string
+	ScopesFile      string
 }
 
+var singletonDhcpServer *NonBlockingDhcpServer = nil
+
 type NonBlockingDhcpServer struct {
 	conf    DhcpConf
+	leases  *LeaseDB
+	statics *StaticHosts
+	scopes  []*Scope
 	wg      *sync.WaitGroup
 	server  *server4.Server
 	started bool
 }
 
-func NewNonBlockingDhcpSever(poolName, ifname string) (*NonBlockingDhcpServer, error) {
-	if poolName == "" {
+// NewNonBlockingDhcpSever creates the dhcp server of the internal network.
+// The dhcp config of ic is checked again against the address the interface
+// really has.
+func NewNonBlockingDhcpSever(ic *k8sinit.InstallConfig) (*NonBlockingDhcpServer, error) {
+	if ic == nil {
 		return nil, k8sinit.K8SInitNotInstalledError
 	}
+	ifname := ic.InternalNetwork
 	addrs, err := network.ListIpAddressesOfIfname(ifname)
 	if err != nil {
 		return nil, err
@@ -57,27 +71,47 @@ func NewNonBlockingDhcpSever(poolName, ifname string) (*NonBlockingDhcpServer, e
 	if len(addrs) == 0 {
 		return nil, errors.New("cannot find server ip address")
 	}
-	lip := addrs[0].IP
-	start := network.Ip2Int(lip)
-	start = ((start >> 4) << 4) + 10
-	size, bits := addrs[0].Mask.Size()
-	rembits := bits - size
-	max := (1 << (rembits + 1)) - 11
+	lip := addrs[0].IP.To4()
+	subnet := &net.IPNet{IP: lip.Mask(addrs[0].Mask), Mask: addrs[0].Mask}
+	local, err := NewScope(ScopeConfig{Name: LocalScopeName, Subnet: subnet.String(), DhcpConfig: ic.Dhcp}, lip)
+	if err != nil {
+		return nil, errors.Wrapf(err, "bad dhcp config of %v", ifname)
+	}
 
-	confbase := fmt.Sprintf("/%v/config/dhcpd.%v.", poolName, ifname)
+	confbase := fmt.Sprintf("/%v/config/dhcpd.%v.", ic.PoolName, ifname)
 	conf := DhcpConf{
 		LeasesFile:      confbase + "leases.json",
 		Interface:       ifname,
 		ServerIP:        lip,
 		StaticHostsFile: confbase + "static.json",
+		ScopesFile:      confbase + "scopes.json",
 		Mask:            addrs[0].Mask,
-		PoolStart:       start,
-		MaxHost:         max,
+		PoolStart:       local.PoolStart,
+		MaxHost:         local.MaxHost,
+		LeaseTime:       local.LeaseTime,
+	}
+
+	relayScopes, err := LoadScopes(conf.ScopesFile, lip, local)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot load dhcp scopes")
+	}
+	scopes := append([]*Scope{local}, relayScopes...)
+
+	statics, err := NewStaticHosts(conf.StaticHostsFile, scopes)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot load dhcp static hosts")
+	}
+	leases, err := NewLeaseDB(conf.LeasesFile, statics)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot load dhcp leases")
 	}
 
 	var wg sync.WaitGroup
 	s := &NonBlockingDhcpServer{
 		conf:    conf,
+		leases:  leases,
+		statics: statics,
+		scopes:  scopes,
 		wg:      &wg,
 		started: false,
 	}
@@ -86,9 +120,27 @@ func NewNonBlockingDhcpSever(poolName, ifname string) (*NonBlockingDhcpServer, e
 		return nil, errors.Wrapf(err, "cannot create dhcp server")
 	}
 	s.server = server
+	singletonDhcpServer = s
 	return s, nil
 }
 
+func GetNonBlockingDhcpServer() *NonBlockingDhcpServer {
+	return singletonDhcpServer
+}
+
+func (s *NonBlockingDhcpServer) Leases() *LeaseDB {
+	return s.leases
+}
+
+func (s *NonBlockingDhcpServer) StaticHosts() *StaticHosts {
+	return s.statics
+}
+
+// LocalScope returns the scope of the network the server is attached to.
+func (s *NonBlockingDhcpServer) LocalScope() *Scope {
+	return s.scopes[0]
+}
+
 func (s *NonBlockingDhcpServer) Start() {
 	s.wg.Add(1)
 	go func() {
@@ -114,6 +166,39 @@ func (s *NonBlockingDhcpServer) Wait() {
 	s.wg.Wait()
 }
 
+// ipxeBinary selects the ipxe binary for the firmware of the client by its
+// system architecture option (93). Clients without it are legacy bios. It
+// returns false for firmware no binary is shipped for.
+func ipxeBinary(m *dhcpv4.DHCPv4) (string, bool) {
+	archs := m.ClientArch()
+	if len(archs) == 0 {
+		return k8sinit.UndiFilename, true
+	}
+	for _, arch := range archs {
+		switch arch {
+		case iana.EFI_X86_64, iana.EFI_BC, iana.EFI_X86_64_HTTP, iana.EFI_BC_HTTP:
+			return k8sinit.IpxeEfiFilename, true
+		case iana.EFI_ARM64, iana.EFI_ARM64_HTTP:
+			return k8sinit.IpxeArm64EfiFilename, true
+		case iana.INTEL_X86PC:
+			return k8sinit.UndiFilename, true
+		}
+	}
+	return "", false
+}
+
+// isHttpClient reports whether the client is uefi http boot firmware, which
+// sends HTTPClient as vendor class (60) and wants a url as boot file.
+func isHttpClient(m *dhcpv4.DHCPv4) bool {
+	return strings.HasPrefix(m.ClassIdentifier(), "HTTPClient")
+}
+
+// HttpUrl is the url of path on the boot http server, where clients are sent
+// to.
+func (s *NonBlockingDhcpServer) HttpUrl(path string) string {
+	return fmt.Sprintf("http://%v:%v%v", s.conf.ServerIP, k8sinit.HttpPort, path)
+}
+
 func (s *NonBlockingDhcpServer) handler(conn net.PacketConn, peer net.Addr, m *dhcpv4.DHCPv4) {
 	if m == nil {
 		return
@@ -122,40 +207,203 @@ func (s *NonBlockingDhcpServer) handler(conn net.PacketConn, peer net.Addr, m *d
 		return
 	}
 	klog.V(0).Infof("dhcp packet: %v, user-class: %v", m, m.UserClass())
-	reply, err := dhcpv4.NewReplyFromRequest(m)
-	if err != nil {
-		klog.V(0).Error(err, "cannot create dhcp reply")
+
+	mt := m.MessageType()
+	if sid := m.ServerIdentifier(); sid != nil && !sid.Equal(s.conf.ServerIP) {
+		// the client talks to another server, our offer is not needed anymore
+		if mt == dhcpv4.MessageTypeRequest {
+			s.leases.CancelOffer(m.ClientHWAddr.String())
+		}
+		klog.V(5).Infof("dhcp %v for server %v ignored", mt, sid)
 		return
 	}
 
-	reply.UpdateOption(dhcpv4.OptServerIdentifier(s.conf.ServerIP))
-	reply.UpdateOption(dhcpv4.OptSubnetMask(s.conf.Mask))
-	reply.UpdateOption(dhcpv4.OptDNS(s.conf.ServerIP))
-	reply.UpdateOption(dhcpv4.OptRouter(s.conf.ServerIP))
-	reply.UpdateOption(dhcpv4.OptNTPServers(s.conf.ServerIP))
-	reply.UpdateOption(dhcpv4.OptIPAddressLeaseTime(time.Minute * 30))
-
-	uses := m.UserClass()
-	if len(uses) == 1 && uses[0] == "iPXE" {
-		reply.UpdateOption(dhcpv4.OptBootFileName(fmt.Sprintf("http://%v:8000/api/network/tftp", s.conf.ServerIP)))
-	} else {
-		reply.UpdateOption(dhcpv4.OptBootFileName(k8sinit.UndiFilename))
+	sc := s.selectScope(m)
+	if sc == nil {
+		klog.V(0).Infof("no dhcp scope for relay %v, packet from %v ignored", m.GatewayIPAddr, m.ClientHWAddr)
+		return
 	}
-	reply.UpdateOption(dhcpv4.OptTFTPServerName(s.conf.ServerIP.String()))
-	reply.YourIPAddr = network.Int2Ip(s.conf.PoolStart)
-	reply.ServerIPAddr = s.conf.ServerIP
 
-	switch mt := m.MessageType(); mt {
+	var reply *dhcpv4.DHCPv4
+	switch mt {
 	case dhcpv4.MessageTypeDiscover:
-		reply.UpdateOption(dhcpv4.OptMessageType(dhcpv4.MessageTypeOffer))
+		reply = s.handleDiscover(sc, m)
 	case dhcpv4.MessageTypeRequest:
-		reply.UpdateOption(dhcpv4.OptMessageType(dhcpv4.MessageTypeAck))
+		reply = s.handleRequest(sc, m)
+	case dhcpv4.MessageTypeRelease:
+		s.handleRelease(m)
+	case dhcpv4.MessageTypeDecline:
+		s.handleDecline(m)
+	case dhcpv4.MessageTypeInform:
+		reply = s.handleInform(sc, m)
 	default:
-		klog.V(0).Error(errors.New("unknown dhcp mt"), "cannot select dhcp mt")
+		klog.V(0).Error(errors.New("unknown dhcp mt"), "cannot select dhcp mt", "mt", mt)
+	}
+	if reply == nil {
 		return
 	}
+	if isRelayed(m) {
+		// replies to relayed packets go to the server port of the relay
+		peer = &net.UDPAddr{IP: m.GatewayIPAddr, Port: dhcpv4.ServerPort}
+	} else if reply.MessageType() == dhcpv4.MessageTypeNak {
+		// a nak is always broadcast, the client may not own its address anymore
+		peer = &net.UDPAddr{IP: net.IPv4bcast, Port: dhcpv4.ClientPort}
+	}
 	klog.V(0).Infof("dhcp packet: %v, user-class: %v", reply, reply.UserClass())
 	if _, err := conn.WriteTo(reply.ToBytes(), peer); err != nil {
 		klog.V(0).Error(err, "cannot send dhcp reply")
 	}
 }
+
+func isRelayed(m *dhcpv4.DHCPv4) bool {
+	return m.GatewayIPAddr != nil && !m.GatewayIPAddr.Equal(net.IPv4zero)
+}
+
+// selectScope returns the local scope for clients on the link and the scope
+// containing giaddr for relayed ones.
+func (s *NonBlockingDhcpServer) selectScope(m *dhcpv4.DHCPv4) *Scope {
+	if !isRelayed(m) {
+		return s.scopes[0]
+	}
+	for _, sc := range s.scopes[1:] {
+		if sc.Subnet.Contains(m.GatewayIPAddr) {
+			return sc
+		}
+	}
+	return nil
+}
+
+func (s *NonBlockingDhcpServer) newReply(sc *Scope, m *dhcpv4.DHCPv4, mt dhcpv4.MessageType) *dhcpv4.DHCPv4 {
+	reply, err := dhcpv4.NewReplyFromRequest(m)
+	if err != nil {
+		klog.V(0).Error(err, "cannot create dhcp reply")
+		return nil
+	}
+	reply.UpdateOption(dhcpv4.OptMessageType(mt))
+	reply.UpdateOption(dhcpv4.OptServerIdentifier(s.conf.ServerIP))
+	if mt == dhcpv4.MessageTypeNak {
+		return reply
+	}
+
+	reply.UpdateOption(dhcpv4.OptSubnetMask(sc.Subnet.Mask))
+	reply.UpdateOption(dhcpv4.OptDNS(sc.DNS...))
+	if len(sc.Router) > 0 {
+		reply.UpdateOption(dhcpv4.OptRouter(sc.Router...))
+	} else if isRelayed(m) {
+		reply.UpdateOption(dhcpv4.OptRouter(m.GatewayIPAddr))
+	}
+	reply.UpdateOption(dhcpv4.OptNTPServers(sc.NTP...))
+	if sc.DomainName != "" {
+		reply.UpdateOption(dhcpv4.OptDomainName(sc.DomainName))
+	}
+	if len(sc.SearchDomains) > 0 {
+		reply.UpdateOption(dhcpv4.OptDomainSearch(&rfc1035label.Labels{Labels: sc.SearchDomains}))
+	}
+	for _, o := range sc.Options {
+		reply.UpdateOption(o)
+	}
+
+	uses := m.UserClass()
+	if len(uses) == 1 && uses[0] == "iPXE" {
+		reply.UpdateOption(dhcpv4.OptBootFileName(s.HttpUrl("/api/network/tftp")))
+		return reply
+	}
+	binary, ok := ipxeBinary(m)
+	if !ok {
+		// the client gets an address but nothing to boot
+		klog.V(0).Infof("no ipxe binary for %v of %v", m.ClientArch(), m.ClientHWAddr)
+		return reply
+	}
+	if isHttpClient(m) {
+		if binary == k8sinit.UndiFilename {
+			klog.V(0).Infof("no ipxe binary for http boot bios of %v", m.ClientHWAddr)
+			return reply
+		}
+		// the firmware ignores offers without the vendor class echoed back
+		reply.UpdateOption(dhcpv4.OptClassIdentifier("HTTPClient"))
+		reply.UpdateOption(dhcpv4.OptBootFileName(s.HttpUrl("/api/network/ipxe/" + binary)))
+		return reply
+	}
+	reply.UpdateOption(dhcpv4.OptBootFileName(binary))
+	reply.UpdateOption(dhcpv4.OptTFTPServerName(s.conf.ServerIP.String()))
+	reply.ServerIPAddr = s.conf.ServerIP
+	return reply
+}
+
+func (s *NonBlockingDhcpServer) newNak(sc *Scope, m *dhcpv4.DHCPv4, reason error) *dhcpv4.DHCPv4 {
+	reply := s.newReply(sc, m, dhcpv4.MessageTypeNak)
+	if reply == nil {
+		return nil
+	}
+	reply.UpdateOption(dhcpv4.OptMessage(reason.Error()))
+	reply.SetBroadcast()
+	return reply
+}
+
+func (s *NonBlockingDhcpServer) handleDiscover(sc *Scope, m *dhcpv4.DHCPv4) *dhcpv4.DHCPv4 {
+	lease, err := s.leases.Offer(sc, m)
+	if err != nil {
+		klog.V(0).Error(err, "cannot offer address", "mac", m.ClientHWAddr, "scope", sc.Name)
+		return nil
+	}
+	reply := s.newReply(sc, m, dhcpv4.MessageTypeOffer)
+	if reply == nil {
+		return nil
+	}
+	reply.UpdateOption(dhcpv4.OptIPAddressLeaseTime(sc.LeaseTime))
+	if lease.Hostname != "" {
+		reply.UpdateOption(dhcpv4.OptHostName(lease.Hostname))
+	}
+	reply.YourIPAddr = lease.IP
+	return reply
+}
+
+// handleRequest serves all request states of rfc 2131. A selecting or
+// init-reboot client sends the address in the requested ip option, a
+// renewing or rebinding one in ciaddr. The server is authoritative for its
+// network, so every address it cannot bind to the client is naked.
+func (s *NonBlockingDhcpServer) handleRequest(sc *Scope, m *dhcpv4.DHCPv4) *dhcpv4.DHCPv4 {
+	reqip := m.RequestedIPAddress()
+	if reqip == nil || reqip.Equal(net.IPv4zero) {
+		reqip = m.ClientIPAddr
+	}
+	if reqip == nil || reqip.Equal(net.IPv4zero) {
+		return s.newNak(sc, m, errors.New("no address requested"))
+	}
+	lease, err := s.leases.Bind(sc, m, reqip)
+	if err != nil {
+		klog.V(0).Error(err, "cannot bind address", "mac", m.ClientHWAddr, "ip", reqip, "scope", sc.Name)
+		return s.newNak(sc, m, err)
+	}
+	reply := s.newReply(sc, m, dhcpv4.MessageTypeAck)
+	if reply == nil {
+		return nil
+	}
+	reply.UpdateOption(dhcpv4.OptIPAddressLeaseTime(sc.LeaseTime))
+	if lease.Hostname != "" {
+		reply.UpdateOption(dhcpv4.OptHostName(lease.Hostname))
+	}
+	reply.YourIPAddr = lease.IP
+	return reply
+}
+
+func (s *NonBlockingDhcpServer) handleRelease(m *dhcpv4.DHCPv4) {
+	if err := s.leases.Release(m.ClientHWAddr.String(), m.ClientIPAddr); err != nil {
+		klog.V(0).Error(err, "cannot release address", "mac", m.ClientHWAddr, "ip", m.ClientIPAddr)
+	}
+}
+
+func (s *NonBlockingDhcpServer) handleDecline(m *dhcpv4.DHCPv4) {
+	ip := m.RequestedIPAddress()
+	if err := s.leases.Decline(m.ClientHWAddr.String(), ip); err != nil {
+		klog.V(0).Error(err, "cannot decline address", "mac", m.ClientHWAddr, "ip", ip)
+		return
+	}
+	klog.V(0).Infof("address %v declined by %v, quarantined", ip, m.ClientHWAddr)
+}
+
+// handleInform answers a client which configured its address itself, so no
+// address is allocated and no lease time is sent.
+func (s *NonBlockingDhcpServer) handleInform(sc *Scope, m *dhcpv4.DHCPv4) *dhcpv4.DHCPv4 {
+	return s.newReply(sc, m, dhcpv4.MessageTypeAck)
+}
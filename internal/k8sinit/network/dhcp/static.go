@@ -0,0 +1,301 @@
+/*
+Copyright 2020 Kazım SARIKAYA
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dhcp
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	StaticHostNotFoundError = errors.New("static host not found")
+	StaticHostExistsError   = errors.New("static host already exists")
+
+	hostnameRegexp = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?$`)
+)
+
+type StaticHostValidationError struct {
+	Reason string
+}
+
+func (e *StaticHostValidationError) Error() string {
+	return "invalid static host: " + e.Reason
+}
+
+type StaticHost struct {
+	MAC      string `json:"mac"`
+	IP       net.IP `json:"ip"`
+	Hostname string `json:"hostname,omitempty"`
+}
+
+type StaticHosts struct {
+	file   string
+	scopes []*Scope
+	// leases is set by the lease db using the reservations. Its lock is
+	// taken before mu.
+	leases *LeaseDB
+	mu     sync.Mutex
+	hosts  map[string]*StaticHost
+}
+
+func NewStaticHosts(file string, scopes []*Scope) (*StaticHosts, error) {
+	sh := &StaticHosts{
+		file:   file,
+		scopes: scopes,
+		hosts:  make(map[string]*StaticHost),
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return sh, nil
+		}
+		return nil, errors.Wrapf(err, "cannot read static hosts file %v", file)
+	}
+	var hosts []*StaticHost
+	if err := json.Unmarshal(data, &hosts); err != nil {
+		return nil, errors.Wrapf(err, "cannot decode static hosts file %v", file)
+	}
+	for _, h := range hosts {
+		// the file may be edited by hand, keys are the canonical form
+		hw, err := net.ParseMAC(h.MAC)
+		if err != nil {
+			return nil, errors.Wrapf(err, "bad mac address %v in static hosts file %v", h.MAC, file)
+		}
+		h.MAC = hw.String()
+		sh.hosts[h.MAC] = h
+	}
+	return sh, nil
+}
+
+// save should be called with sh.mu held.
+func (sh *StaticHosts) save() error {
+	data, err := json.MarshalIndent(sh.list(), "", "  ")
+	if err != nil {
+		return errors.Wrapf(err, "cannot encode static hosts")
+	}
+	tmp := sh.file + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return errors.Wrapf(err, "cannot write static hosts file %v", tmp)
+	}
+	if err := os.Rename(tmp, sh.file); err != nil {
+		return errors.Wrapf(err, "cannot replace static hosts file %v", sh.file)
+	}
+	return nil
+}
+
+func (sh *StaticHosts) list() []StaticHost {
+	result := make([]StaticHost, 0, len(sh.hosts))
+	for _, h := range sh.hosts {
+		result = append(result, *h)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].MAC < result[j].MAC
+	})
+	return result
+}
+
+// lock takes the lock of the lease db before mu, the lease db reads the
+// reservations holding its lock.
+func (sh *StaticHosts) lock() {
+	if sh.leases != nil {
+		sh.leases.mu.Lock()
+	}
+	sh.mu.Lock()
+}
+
+func (sh *StaticHosts) unlock() {
+	sh.mu.Unlock()
+	if sh.leases != nil {
+		sh.leases.mu.Unlock()
+	}
+}
+
+// validate normalizes the mac address of h and checks it against the other
+// reservations, ignoring the one with mac skip, and the active leases. It
+// should be called with lock held.
+func (sh *StaticHosts) validate(h *StaticHost, skip string) error {
+	hw, err := net.ParseMAC(h.MAC)
+	if err != nil {
+		return &StaticHostValidationError{Reason: fmt.Sprintf("bad mac address %v", h.MAC)}
+	}
+	h.MAC = hw.String()
+	ip := h.IP.To4()
+	if ip == nil {
+		return &StaticHostValidationError{Reason: "ip address is not ipv4"}
+	}
+	h.IP = ip
+	assignable := false
+	for _, sc := range sh.scopes {
+		if sc.Assignable(ip) {
+			assignable = true
+			break
+		}
+	}
+	if !assignable {
+		return &StaticHostValidationError{Reason: fmt.Sprintf("ip address %v cannot be reserved in any scope", ip)}
+	}
+	if h.Hostname != "" && !hostnameRegexp.MatchString(h.Hostname) {
+		return &StaticHostValidationError{Reason: fmt.Sprintf("bad hostname %v", h.Hostname)}
+	}
+	for mac, o := range sh.hosts {
+		if mac == skip || mac == h.MAC {
+			continue
+		}
+		if o.IP.Equal(ip) {
+			return &StaticHostValidationError{Reason: fmt.Sprintf("ip address %v is reserved for %v", ip, mac)}
+		}
+		if h.Hostname != "" && o.Hostname == h.Hostname {
+			return &StaticHostValidationError{Reason: fmt.Sprintf("hostname %v is reserved for %v", h.Hostname, mac)}
+		}
+	}
+	if sh.leases != nil {
+		if holder := sh.leases.activeHolder(ip, h.MAC, time.Now()); holder != "" {
+			return &StaticHostValidationError{Reason: fmt.Sprintf("ip address %v is leased to %v, revoke the lease first", ip, holder)}
+		}
+	}
+	return nil
+}
+
+func (sh *StaticHosts) List() []StaticHost {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	return sh.list()
+}
+
+func (sh *StaticHosts) Get(mac string) (StaticHost, error) {
+	hw, err := net.ParseMAC(mac)
+	if err != nil {
+		return StaticHost{}, &StaticHostValidationError{Reason: fmt.Sprintf("bad mac address %v", mac)}
+	}
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	h, ok := sh.hosts[hw.String()]
+	if !ok {
+		return StaticHost{}, StaticHostNotFoundError
+	}
+	return *h, nil
+}
+
+func (sh *StaticHosts) Add(h StaticHost) (StaticHost, error) {
+	sh.lock()
+	defer sh.unlock()
+	if err := sh.validate(&h, ""); err != nil {
+		return StaticHost{}, err
+	}
+	if _, ok := sh.hosts[h.MAC]; ok {
+		return StaticHost{}, StaticHostExistsError
+	}
+	sh.hosts[h.MAC] = &h
+	if err := sh.save(); err != nil {
+		delete(sh.hosts, h.MAC)
+		return StaticHost{}, err
+	}
+	return h, nil
+}
+
+// Update replaces the reservation of mac with h. The mac address itself can
+// be changed too.
+func (sh *StaticHosts) Update(mac string, h StaticHost) (StaticHost, error) {
+	hw, err := net.ParseMAC(mac)
+	if err != nil {
+		return StaticHost{}, &StaticHostValidationError{Reason: fmt.Sprintf("bad mac address %v", mac)}
+	}
+	mac = hw.String()
+	if h.MAC == "" {
+		h.MAC = mac
+	}
+	sh.lock()
+	defer sh.unlock()
+	old, ok := sh.hosts[mac]
+	if !ok {
+		return StaticHost{}, StaticHostNotFoundError
+	}
+	if err := sh.validate(&h, mac); err != nil {
+		return StaticHost{}, err
+	}
+	if _, ok := sh.hosts[h.MAC]; ok && h.MAC != mac {
+		return StaticHost{}, StaticHostExistsError
+	}
+	delete(sh.hosts, mac)
+	sh.hosts[h.MAC] = &h
+	if err := sh.save(); err != nil {
+		delete(sh.hosts, h.MAC)
+		sh.hosts[mac] = old
+		return StaticHost{}, err
+	}
+	return h, nil
+}
+
+func (sh *StaticHosts) Delete(mac string) error {
+	hw, err := net.ParseMAC(mac)
+	if err != nil {
+		return &StaticHostValidationError{Reason: fmt.Sprintf("bad mac address %v", mac)}
+	}
+	mac = hw.String()
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	old, ok := sh.hosts[mac]
+	if !ok {
+		return StaticHostNotFoundError
+	}
+	delete(sh.hosts, mac)
+	if err := sh.save(); err != nil {
+		sh.hosts[mac] = old
+		return err
+	}
+	return nil
+}
+
+// reservedIP returns the address reserved for mac, if any.
+func (sh *StaticHosts) reservedIP(mac string) net.IP {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	if h, ok := sh.hosts[mac]; ok {
+		return h.IP
+	}
+	return nil
+}
+
+// reservedHostname returns the hostname reserved for mac, if any.
+func (sh *StaticHosts) reservedHostname(mac string) string {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	if h, ok := sh.hosts[mac]; ok {
+		return h.Hostname
+	}
+	return ""
+}
+
+// isReserved reports whether ip is reserved for any client.
+func (sh *StaticHosts) isReserved(ip net.IP) bool {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	for _, h := range sh.hosts {
+		if h.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,416 @@
+/*
+Copyright 2020 Kazım SARIKAYA
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dns
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"github.com/pkg/errors"
+	"golang.org/x/net/dns/dnsmessage"
+	"io"
+	klog "k8s.io/klog/v2"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultResolvConf = "/etc/resolv.conf"
+
+	localTTL        = 60
+	upstreamTimeout = 2 * time.Second
+	tcpIdleTimeout  = 10 * time.Second
+)
+
+// LocalResolver resolves the names of the local zone, the dhcp lease
+// database implements it.
+type LocalResolver interface {
+	LookupName(name string) net.IP
+	LookupAddr(ip net.IP) string
+}
+
+// DnsConf configures the dns server. Names under Domain and single label
+// names are answered by Resolver, reverse queries of Subnet too. Other
+// queries go to Upstreams, host:port addresses, or to the name servers of
+// ResolvConf when Upstreams is empty.
+type DnsConf struct {
+	Domain     string
+	Subnet     *net.IPNet
+	Resolver   LocalResolver
+	Upstreams  []string
+	ResolvConf string
+}
+
+type NonBlockingDnsServer struct {
+	conf     DnsConf
+	listenIP net.IP
+	udpConn  net.PacketConn
+	tcpLn    net.Listener
+	wg       *sync.WaitGroup
+	started  bool
+}
+
+func NewNonBlockingDnsServer(conf DnsConf) (*NonBlockingDnsServer, error) {
+	if conf.Resolver == nil {
+		return nil, errors.New("dns server needs a local resolver")
+	}
+	conf.Domain = strings.ToLower(strings.Trim(conf.Domain, "."))
+	if conf.ResolvConf == "" {
+		conf.ResolvConf = DefaultResolvConf
+	}
+	var wg sync.WaitGroup
+	s := &NonBlockingDnsServer{
+		conf:    conf,
+		wg:      &wg,
+		started: false,
+	}
+	return s, nil
+}
+
+// Start listens on udp and tcp port 53 of ipaddr.
+func (s *NonBlockingDnsServer) Start(ipaddr string) error {
+	addr := net.JoinHostPort(ipaddr, "53")
+	udpConn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return errors.Wrapf(err, "cannot listen dns udp %v", addr)
+	}
+	tcpLn, err := net.Listen("tcp", addr)
+	if err != nil {
+		udpConn.Close()
+		return errors.Wrapf(err, "cannot listen dns tcp %v", addr)
+	}
+	s.udpConn, s.tcpLn = udpConn, tcpLn
+	s.listenIP = net.ParseIP(ipaddr)
+	s.started = true
+	s.wg.Add(2)
+	go s.serveUdp()
+	go s.serveTcp()
+	klog.V(0).Infof("dns server started at %v", addr)
+	return nil
+}
+
+func (s *NonBlockingDnsServer) Stop() {
+	if s.started {
+		s.started = false
+		s.udpConn.Close()
+		s.tcpLn.Close()
+	}
+	s.Wait()
+}
+
+func (s *NonBlockingDnsServer) Wait() {
+	s.wg.Wait()
+}
+
+func (s *NonBlockingDnsServer) serveUdp() {
+	defer s.wg.Done()
+	for {
+		buf := make([]byte, 4096)
+		n, peer, err := s.udpConn.ReadFrom(buf)
+		if err != nil {
+			if s.started {
+				klog.V(0).Error(err, "dns udp server stopped")
+			}
+			return
+		}
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			if reply := s.handle(buf[:n], "udp"); reply != nil {
+				s.udpConn.WriteTo(reply, peer)
+			}
+		}()
+	}
+}
+
+func (s *NonBlockingDnsServer) serveTcp() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.tcpLn.Accept()
+		if err != nil {
+			if s.started {
+				klog.V(0).Error(err, "dns tcp server stopped")
+			}
+			return
+		}
+		go func() {
+			defer conn.Close()
+			for {
+				conn.SetDeadline(time.Now().Add(tcpIdleTimeout))
+				query, err := readTcpMessage(conn)
+				if err != nil {
+					return
+				}
+				reply := s.handle(query, "tcp")
+				if reply == nil || writeTcpMessage(conn, reply) != nil {
+					return
+				}
+			}
+		}()
+	}
+}
+
+func readTcpMessage(r io.Reader) ([]byte, error) {
+	var size uint16
+	if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, size)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+func writeTcpMessage(w io.Writer, msg []byte) error {
+	buf := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(buf, uint16(len(msg)))
+	copy(buf[2:], msg)
+	_, err := w.Write(buf)
+	return err
+}
+
+// handle answers a query from the local zone or forwards it. network is the
+// transport the query came with, forwarding uses the same one.
+func (s *NonBlockingDnsServer) handle(query []byte, network string) []byte {
+	var p dnsmessage.Parser
+	h, err := p.Start(query)
+	if err != nil || h.Response {
+		return nil
+	}
+	q, err := p.Question()
+	if err != nil {
+		return s.reply(h, nil, dnsmessage.RCodeFormatError, false, nil)
+	}
+	if reply, ok := s.answerLocal(h, q); ok {
+		return reply
+	}
+	reply, err := s.forward(query, h.ID, network)
+	if err != nil {
+		klog.V(5).Error(err, "cannot forward dns query", "name", q.Name, "type", q.Type)
+		return s.reply(h, &q, dnsmessage.RCodeServerFailure, false, nil)
+	}
+	return reply
+}
+
+// answerLocal answers q if it belongs to the local zone.
+func (s *NonBlockingDnsServer) answerLocal(h dnsmessage.Header, q dnsmessage.Question) ([]byte, bool) {
+	name := strings.ToLower(strings.TrimSuffix(q.Name.String(), "."))
+	if strings.HasSuffix(name, ".in-addr.arpa") {
+		ip := reverseIP(strings.TrimSuffix(name, ".in-addr.arpa"))
+		if ip == nil || s.conf.Subnet == nil || !s.conf.Subnet.Contains(ip) {
+			return nil, false
+		}
+		hn := s.conf.Resolver.LookupAddr(ip)
+		if hn == "" {
+			return s.reply(h, &q, dnsmessage.RCodeNameError, true, nil), true
+		}
+		if q.Type != dnsmessage.TypePTR && q.Type != dnsmessage.TypeALL {
+			return s.reply(h, &q, dnsmessage.RCodeSuccess, true, nil), true
+		}
+		ptr, err := dnsmessage.NewName(s.fqdn(hn))
+		if err != nil {
+			return s.reply(h, &q, dnsmessage.RCodeServerFailure, true, nil), true
+		}
+		return s.reply(h, &q, dnsmessage.RCodeSuccess, true, func(b *dnsmessage.Builder) error {
+			return b.PTRResource(dnsmessage.ResourceHeader{Name: q.Name, Class: dnsmessage.ClassINET, TTL: localTTL},
+				dnsmessage.PTRResource{PTR: ptr})
+		}), true
+	}
+
+	host := ""
+	if s.conf.Domain != "" && strings.HasSuffix(name, "."+s.conf.Domain) {
+		host = strings.TrimSuffix(name, "."+s.conf.Domain)
+	} else if name != "" && !strings.Contains(name, ".") {
+		host = name
+	}
+	if host == "" || strings.Contains(host, ".") {
+		return nil, false
+	}
+	ip := s.conf.Resolver.LookupName(host).To4()
+	if ip == nil {
+		return s.reply(h, &q, dnsmessage.RCodeNameError, true, nil), true
+	}
+	if q.Type != dnsmessage.TypeA && q.Type != dnsmessage.TypeALL {
+		return s.reply(h, &q, dnsmessage.RCodeSuccess, true, nil), true
+	}
+	var a [4]byte
+	copy(a[:], ip)
+	return s.reply(h, &q, dnsmessage.RCodeSuccess, true, func(b *dnsmessage.Builder) error {
+		return b.AResource(dnsmessage.ResourceHeader{Name: q.Name, Class: dnsmessage.ClassINET, TTL: localTTL},
+			dnsmessage.AResource{A: a})
+	}), true
+}
+
+func (s *NonBlockingDnsServer) fqdn(host string) string {
+	if s.conf.Domain == "" {
+		return host + "."
+	}
+	return host + "." + s.conf.Domain + "."
+}
+
+// reply builds a response to the query with header h. answer adds the
+// answer records, it may be nil.
+func (s *NonBlockingDnsServer) reply(h dnsmessage.Header, q *dnsmessage.Question, rcode dnsmessage.RCode,
+	authoritative bool, answer func(b *dnsmessage.Builder) error) []byte {
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{
+		ID:                 h.ID,
+		Response:           true,
+		OpCode:             h.OpCode,
+		Authoritative:      authoritative,
+		RecursionDesired:   h.RecursionDesired,
+		RecursionAvailable: true,
+		RCode:              rcode,
+	})
+	b.EnableCompression()
+	if err := b.StartQuestions(); err != nil {
+		return nil
+	}
+	if q != nil {
+		if err := b.Question(*q); err != nil {
+			return nil
+		}
+	}
+	if answer != nil {
+		if err := b.StartAnswers(); err != nil {
+			return nil
+		}
+		if err := answer(&b); err != nil {
+			klog.V(5).Error(err, "cannot build dns answer")
+			return nil
+		}
+	}
+	msg, err := b.Finish()
+	if err != nil {
+		klog.V(5).Error(err, "cannot build dns reply")
+		return nil
+	}
+	return msg
+}
+
+// reverseIP parses the ipv4 address of a name under in-addr.arpa.
+func reverseIP(name string) net.IP {
+	parts := strings.Split(name, ".")
+	if len(parts) != 4 {
+		return nil
+	}
+	for i, j := 0, len(parts)-1; i < j; i, j = i+1, j-1 {
+		parts[i], parts[j] = parts[j], parts[i]
+	}
+	return net.ParseIP(strings.Join(parts, ".")).To4()
+}
+
+// upstreams returns the upstream servers without the server itself, a
+// resolv.conf pointing to the server would loop queries forever.
+func (s *NonBlockingDnsServer) upstreams() []string {
+	ups := s.conf.Upstreams
+	if len(ups) == 0 {
+		var err error
+		if ups, err = ReadResolvConf(s.conf.ResolvConf); err != nil {
+			klog.V(5).Error(err, "cannot read upstream dns servers")
+		}
+	}
+	result := make([]string, 0, len(ups))
+	for _, up := range ups {
+		if s.isSelf(up) {
+			klog.V(5).Infof("skipping upstream dns server %v, it is the server itself", up)
+			continue
+		}
+		result = append(result, up)
+	}
+	return result
+}
+
+// isSelf reports whether the upstream address up is the listen address of
+// the server. Loopback addresses are the server too when it listens on all
+// addresses.
+func (s *NonBlockingDnsServer) isSelf(up string) bool {
+	host, port, err := net.SplitHostPort(up)
+	if err != nil || port != "53" || s.listenIP == nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	return ip.Equal(s.listenIP) || (s.listenIP.IsUnspecified() && ip.IsLoopback())
+}
+
+// forward sends the query to the upstream servers in order and returns the
+// first answer.
+func (s *NonBlockingDnsServer) forward(query []byte, id uint16, network string) ([]byte, error) {
+	ups := s.upstreams()
+	if len(ups) == 0 {
+		return nil, errors.New("no upstream dns server")
+	}
+	// upstreams see a random id, so their replies cannot be spoofed by
+	// guessing the id the client chose
+	var b [2]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return nil, errors.Wrapf(err, "cannot generate query id")
+	}
+	upID := binary.BigEndian.Uint16(b[:])
+	upQuery := append([]byte(nil), query...)
+	binary.BigEndian.PutUint16(upQuery, upID)
+	var lastErr error
+	for _, up := range ups {
+		reply, err := exchange(upQuery, upID, network, up)
+		if err == nil {
+			binary.BigEndian.PutUint16(reply, id)
+			return reply, nil
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+func exchange(query []byte, id uint16, network, upstream string) ([]byte, error) {
+	conn, err := net.DialTimeout(network, upstream, upstreamTimeout)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot connect %v", upstream)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(upstreamTimeout))
+	if network == "tcp" {
+		if err := writeTcpMessage(conn, query); err != nil {
+			return nil, errors.Wrapf(err, "cannot send query to %v", upstream)
+		}
+		reply, err := readTcpMessage(conn)
+		if err != nil {
+			return nil, errors.Wrapf(err, "cannot read reply of %v", upstream)
+		}
+		if len(reply) < 2 || binary.BigEndian.Uint16(reply) != id {
+			return nil, errors.Errorf("reply of %v has another id", upstream)
+		}
+		return reply, nil
+	}
+	if _, err := conn.Write(query); err != nil {
+		return nil, errors.Wrapf(err, "cannot send query to %v", upstream)
+	}
+	buf := make([]byte, 65535)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, errors.Wrapf(err, "cannot read reply of %v", upstream)
+		}
+		// drop stray packets, the reply carries the id of the query
+		if n >= 2 && binary.BigEndian.Uint16(buf) == id {
+			return buf[:n], nil
+		}
+	}
+}
@@ -0,0 +1,343 @@
+/*
+Copyright 2020 Kazım SARIKAYA
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dns
+
+import (
+	"bytes"
+	"encoding/binary"
+	"golang.org/x/net/dns/dnsmessage"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+var upstreamAnswer = [4]byte{192, 0, 2, 1}
+
+// stubUpstream answers every A query with upstreamAnswer over udp and tcp
+// and records the ids it sees.
+type stubUpstream struct {
+	udp net.PacketConn
+	tcp net.Listener
+	mu  sync.Mutex
+	ids []uint16
+}
+
+func (u *stubUpstream) answer(t *testing.T, query []byte) []byte {
+	var p dnsmessage.Parser
+	h, err := p.Start(query)
+	if err != nil {
+		t.Errorf("upstream cannot parse query: %v", err)
+		return nil
+	}
+	q, err := p.Question()
+	if err != nil {
+		t.Errorf("upstream cannot parse question: %v", err)
+		return nil
+	}
+	u.mu.Lock()
+	u.ids = append(u.ids, h.ID)
+	u.mu.Unlock()
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: h.ID, Response: true, RecursionAvailable: true})
+	b.StartQuestions()
+	b.Question(q)
+	b.StartAnswers()
+	b.AResource(dnsmessage.ResourceHeader{Name: q.Name, Class: dnsmessage.ClassINET, TTL: 30},
+		dnsmessage.AResource{A: upstreamAnswer})
+	msg, err := b.Finish()
+	if err != nil {
+		t.Errorf("upstream cannot build reply: %v", err)
+	}
+	return msg
+}
+
+func (u *stubUpstream) serve(t *testing.T) {
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			n, peer, err := u.udp.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			u.udp.WriteTo(u.answer(t, buf[:n]), peer)
+		}
+	}()
+	go func() {
+		for {
+			conn, err := u.tcp.Accept()
+			if err != nil {
+				return
+			}
+			query, err := readTcpMessage(conn)
+			if err == nil {
+				writeTcpMessage(conn, u.answer(t, query))
+			}
+			conn.Close()
+		}
+	}()
+}
+
+func (u *stubUpstream) addr() string {
+	return u.udp.LocalAddr().String()
+}
+
+func (u *stubUpstream) seenIDs() []uint16 {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return append([]uint16(nil), u.ids...)
+}
+
+// newStubUpstream listens on the same udp and tcp port of the loopback.
+func newStubUpstream(t *testing.T) *stubUpstream {
+	for i := 0; i < 10; i++ {
+		udp, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, port, _ := net.SplitHostPort(udp.LocalAddr().String())
+		tcp, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", port))
+		if err != nil {
+			udp.Close()
+			continue
+		}
+		u := &stubUpstream{udp: udp, tcp: tcp}
+		t.Cleanup(func() {
+			udp.Close()
+			tcp.Close()
+		})
+		u.serve(t)
+		return u
+	}
+	t.Fatal("cannot find a free port for the stub upstream")
+	return nil
+}
+
+type fakeResolver map[string]net.IP
+
+func (r fakeResolver) LookupName(name string) net.IP {
+	return r[name]
+}
+
+func (r fakeResolver) LookupAddr(ip net.IP) string {
+	for name, addr := range r {
+		if addr.Equal(ip) {
+			return name
+		}
+	}
+	return ""
+}
+
+func newTestServer(t *testing.T, upstreams ...string) *NonBlockingDnsServer {
+	_, subnet, _ := net.ParseCIDR("10.0.0.0/24")
+	s, err := NewNonBlockingDnsServer(DnsConf{
+		Domain:    "k8s.local",
+		Subnet:    subnet,
+		Resolver:  fakeResolver{"node1": net.ParseIP("10.0.0.5")},
+		Upstreams: upstreams,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func buildQuery(t *testing.T, id uint16, name string, qtype dnsmessage.Type) []byte {
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: id, RecursionDesired: true})
+	b.StartQuestions()
+	b.Question(dnsmessage.Question{Name: dnsmessage.MustNewName(name), Type: qtype, Class: dnsmessage.ClassINET})
+	msg, err := b.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+func parseReply(t *testing.T, reply []byte) (dnsmessage.Header, []dnsmessage.Resource) {
+	if reply == nil {
+		t.Fatal("no reply")
+	}
+	var msg dnsmessage.Message
+	if err := msg.Unpack(reply); err != nil {
+		t.Fatalf("cannot parse reply: %v", err)
+	}
+	return msg.Header, msg.Answers
+}
+
+func TestForward(t *testing.T) {
+	for _, network := range []string{"udp", "tcp"} {
+		t.Run(network, func(t *testing.T) {
+			u := newStubUpstream(t)
+			s := newTestServer(t, u.addr())
+			const clientID = 0x1234
+			for i := 0; i < 4; i++ {
+				h, answers := parseReply(t, s.handle(buildQuery(t, clientID, "example.com.", dnsmessage.TypeA), network))
+				if h.ID != clientID {
+					t.Errorf("reply id %#x, want %#x", h.ID, clientID)
+				}
+				if h.RCode != dnsmessage.RCodeSuccess || len(answers) != 1 {
+					t.Fatalf("rcode %v with %v answers", h.RCode, len(answers))
+				}
+				if a := answers[0].Body.(*dnsmessage.AResource).A; a != upstreamAnswer {
+					t.Errorf("answer %v, want %v", a, upstreamAnswer)
+				}
+			}
+			ids := u.seenIDs()
+			if len(ids) != 4 {
+				t.Fatalf("upstream got %v queries, want 4", len(ids))
+			}
+			rewritten := false
+			for _, id := range ids {
+				rewritten = rewritten || id != clientID
+			}
+			if !rewritten {
+				t.Errorf("upstream saw the client id in every query")
+			}
+		})
+	}
+}
+
+func TestUpstreamsSkipSelf(t *testing.T) {
+	tests := []struct {
+		name     string
+		listen   string
+		upstream []string
+		want     []string
+	}{
+		{"not started", "", []string{"10.0.0.1:53"}, []string{"10.0.0.1:53"}},
+		{"listen address", "10.0.0.1", []string{"10.0.0.1:53", "192.0.2.53:53"}, []string{"192.0.2.53:53"}},
+		{"other port", "10.0.0.1", []string{"10.0.0.1:5353"}, []string{"10.0.0.1:5353"}},
+		{"loopback", "10.0.0.1", []string{"127.0.0.1:53"}, []string{"127.0.0.1:53"}},
+		{"loopback of any address", "0.0.0.0", []string{"127.0.0.1:53", "[::1]:53", "192.0.2.53:53"}, []string{"192.0.2.53:53"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, tt.upstream...)
+			s.listenIP = net.ParseIP(tt.listen)
+			ups := s.upstreams()
+			if len(ups) != len(tt.want) {
+				t.Fatalf("upstreams %v, want %v", ups, tt.want)
+			}
+			for i := range tt.want {
+				if ups[i] != tt.want[i] {
+					t.Errorf("upstreams %v, want %v", ups, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestReadResolvConf(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dns")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "resolv.conf")
+	data := "search example.org\nnameserver 192.0.2.53\nnameserver bad\n# nameserver 192.0.2.1\nnameserver fd00::53\n"
+	if err := ioutil.WriteFile(file, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ups, err := ReadResolvConf(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"192.0.2.53:53", "[fd00::53]:53"}
+	if len(ups) != len(want) {
+		t.Fatalf("name servers %v, want %v", ups, want)
+	}
+	for i := range want {
+		if ups[i] != want[i] {
+			t.Errorf("name servers %v, want %v", ups, want)
+		}
+	}
+}
+
+func TestLocalA(t *testing.T) {
+	s := newTestServer(t)
+	for _, name := range []string{"node1.k8s.local.", "NODE1.k8s.local.", "node1."} {
+		h, answers := parseReply(t, s.handle(buildQuery(t, 7, name, dnsmessage.TypeA), "udp"))
+		if h.ID != 7 || !h.Authoritative || h.RCode != dnsmessage.RCodeSuccess {
+			t.Fatalf("%v: bad header %+v", name, h)
+		}
+		if len(answers) != 1 || answers[0].Body.(*dnsmessage.AResource).A != [4]byte{10, 0, 0, 5} {
+			t.Errorf("%v: bad answers %v", name, answers)
+		}
+	}
+}
+
+func TestLocalPTR(t *testing.T) {
+	s := newTestServer(t)
+	h, answers := parseReply(t, s.handle(buildQuery(t, 8, "5.0.0.10.in-addr.arpa.", dnsmessage.TypePTR), "udp"))
+	if !h.Authoritative || h.RCode != dnsmessage.RCodeSuccess {
+		t.Fatalf("bad header %+v", h)
+	}
+	if len(answers) != 1 {
+		t.Fatalf("%v answers, want 1", len(answers))
+	}
+	if ptr := answers[0].Body.(*dnsmessage.PTRResource).PTR.String(); ptr != "node1.k8s.local." {
+		t.Errorf("ptr %v, want node1.k8s.local.", ptr)
+	}
+}
+
+func TestLocalNXDomain(t *testing.T) {
+	s := newTestServer(t)
+	queries := []struct {
+		name  string
+		qtype dnsmessage.Type
+	}{
+		{"nope.k8s.local.", dnsmessage.TypeA},
+		{"nope.", dnsmessage.TypeA},
+		{"9.0.0.10.in-addr.arpa.", dnsmessage.TypePTR},
+	}
+	for _, q := range queries {
+		h, answers := parseReply(t, s.handle(buildQuery(t, 9, q.name, q.qtype), "udp"))
+		if h.RCode != dnsmessage.RCodeNameError || !h.Authoritative || len(answers) != 0 {
+			t.Errorf("%v: rcode %v authoritative %v with %v answers, want authoritative nxdomain",
+				q.name, h.RCode, h.Authoritative, len(answers))
+		}
+	}
+}
+
+func TestTcpFraming(t *testing.T) {
+	var buf bytes.Buffer
+	msgs := [][]byte{[]byte("first"), {}, bytes.Repeat([]byte{0xab}, 300)}
+	for _, m := range msgs {
+		if err := writeTcpMessage(&buf, m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := binary.BigEndian.Uint16(buf.Bytes()); got != 5 {
+		t.Errorf("length prefix %v, want 5", got)
+	}
+	for _, want := range msgs {
+		got, err := readTcpMessage(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("read %q, want %q", got, want)
+		}
+	}
+	if _, err := readTcpMessage(&buf); err == nil {
+		t.Error("read from an empty stream succeeded")
+	}
+	if _, err := readTcpMessage(bytes.NewReader([]byte{0, 10, 1, 2, 3})); err == nil {
+		t.Error("read of a truncated message succeeded")
+	}
+}
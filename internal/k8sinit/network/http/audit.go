@@ -0,0 +1,151 @@
+/*
+Copyright 2020 Kazım SARIKAYA
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package http
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/kazimsarikaya/k8sinit/internal/k8sinit/api"
+	"github.com/kazimsarikaya/k8sinit/internal/k8sinit/audit"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	maxAuditBody  = 64 << 10
+	maxAuditError = 1024
+)
+
+// auditRecorder keeps the status and the start of the error message of a
+// response. Websocket upgrades hijack the connection through it.
+type auditRecorder struct {
+	http.ResponseWriter
+	status int
+	errBuf bytes.Buffer
+}
+
+func (rec *auditRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *auditRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	if rec.status >= 400 && rec.errBuf.Len() < maxAuditError {
+		rec.errBuf.Write(b)
+	}
+	return rec.ResponseWriter.Write(b)
+}
+
+func (rec *auditRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := rec.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("response cannot be hijacked")
+	}
+	rec.status = http.StatusSwitchingProtocols
+	return h.Hijack()
+}
+
+func (rec *auditRecorder) Flush() {
+	if f, ok := rec.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// auditParams collects the route variables, the query and the json body of
+// r. The body is put back for the handler, other bodies are only counted.
+func auditParams(r *http.Request) map[string]interface{} {
+	params := make(map[string]interface{})
+	for k, v := range mux.Vars(r) {
+		params[k] = v
+	}
+	for k, v := range r.URL.Query() {
+		params[k] = strings.Join(v, ",")
+	}
+	if r.Body != nil && r.Body != http.NoBody {
+		head, _ := ioutil.ReadAll(io.LimitReader(r.Body, maxAuditBody))
+		r.Body = ioutil.NopCloser(io.MultiReader(bytes.NewReader(head), r.Body))
+		var body interface{}
+		if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") || json.Valid(head) {
+			if json.Unmarshal(head, &body) == nil {
+				params["body"] = body
+			}
+		}
+		if _, ok := params["body"]; !ok && len(head) > 0 {
+			params["body"] = fmt.Sprintf("%v bytes of %v", r.ContentLength, r.Header.Get("Content-Type"))
+		}
+	}
+	if len(params) == 0 {
+		return nil
+	}
+	return audit.Redact(params).(map[string]interface{})
+}
+
+// auditMiddleware records every request other than reads and preflights,
+// and every websocket session, in the audit log.
+func auditMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		websocket := strings.EqualFold(r.Header.Get("Upgrade"), "websocket")
+		l := audit.GetLogger()
+		if l == nil || (!websocket && (r.Method == http.MethodGet || r.Method == http.MethodHead || r.Method == http.MethodOptions)) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		source, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			source = r.RemoteAddr
+		}
+		e := &audit.Entry{
+			Time:      time.Now(),
+			Source:    source,
+			Method:    r.Method,
+			Path:      r.URL.Path,
+			Websocket: websocket,
+			Params:    auditParams(r),
+		}
+		if route := mux.CurrentRoute(r); route != nil {
+			e.Route, _ = route.GetPathTemplate()
+		}
+		rec := &auditRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r.WithContext(audit.WithEntry(r.Context(), e)))
+		e.Status = rec.status
+		if e.Status == 0 {
+			e.Status = http.StatusOK
+		}
+		if e.Status >= 400 {
+			var resp api.Response
+			if json.Unmarshal(rec.errBuf.Bytes(), &resp) == nil && resp.Error != nil {
+				e.Error = string(resp.Error.Code) + ": " + resp.Error.Message
+			} else {
+				e.Error = strings.TrimSpace(rec.errBuf.String())
+			}
+		}
+		e.DurationMs = time.Since(e.Time).Milliseconds()
+		l.Log(e)
+	})
+}
@@ -0,0 +1,80 @@
+/*
+Copyright 2020 Kazım SARIKAYA
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package http
+
+import (
+	"github.com/gorilla/mux"
+	"github.com/kazimsarikaya/k8sinit/internal/k8sinit/api"
+	"github.com/kazimsarikaya/k8sinit/internal/k8sinit/audit"
+	"github.com/kazimsarikaya/k8sinit/internal/k8sinit/auth"
+	klog "k8s.io/klog/v2"
+	"net/http"
+)
+
+// authMiddleware checks that the request has a session or a token with the
+// scope of its route. Routes without a scope, like the static files of the
+// web ui, are public.
+func (s *NonBlockingHttpServer) authMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		scope := auth.ScopeNone
+		if route := mux.CurrentRoute(r); route != nil {
+			scope = s.scopes[route]
+		}
+		if scope == auth.ScopeNone || r.Method == http.MethodOptions {
+			next.ServeHTTP(w, r)
+			return
+		}
+		a := auth.GetAuthenticator()
+		if a == nil {
+			api.WriteError(w, api.ErrorNotReady, "authentication is not ready")
+			return
+		}
+		session, err := a.Authenticate(auth.RequestToken(r))
+		if err != nil {
+			klog.V(5).Infof("unauthenticated %v %v from %v", r.Method, r.URL.Path, r.RemoteAddr)
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			api.WriteError(w, api.ErrorUnauthorized, err.Error())
+			return
+		}
+		audit.SetIdentity(r.Context(), session.Username)
+		if !session.Allows(scope) {
+			klog.V(0).Infof("%v is not allowed to %v %v, needs %v", session.Username, r.Method, r.URL.Path, scope)
+			api.WriteError(w, api.ErrorForbidden, auth.ForbiddenError.Error())
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// corsMiddleware allows cross origin requests only from the origin of the
+// server itself.
+func corsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin != "" && origin == "https://"+r.Host {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Set("Access-Control-Allow-Credentials", "true")
+			w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
+		}
+		w.Header().Add("Vary", "Origin")
+		if r.Method == http.MethodOptions {
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
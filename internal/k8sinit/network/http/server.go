@@ -18,23 +18,44 @@ package http
 
 import (
 	"context"
-	"encoding/json"
+	"crypto/tls"
+	"fmt"
 	"github.com/gorilla/mux"
+	"github.com/kazimsarikaya/k8sinit/htdocs"
+	"github.com/kazimsarikaya/k8sinit/internal/k8sinit"
 	"github.com/kazimsarikaya/k8sinit/internal/k8sinit/api"
+	"github.com/kazimsarikaya/k8sinit/internal/k8sinit/auth"
+	"github.com/kazimsarikaya/k8sinit/internal/k8sinit/boot"
+	"github.com/kazimsarikaya/k8sinit/internal/k8sinit/pki"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+	"io/fs"
 	klog "k8s.io/klog/v2"
 	"mime"
+	"net"
 	"net/http"
 	"os"
-	"path/filepath"
+	"path"
+	"strconv"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
 )
 
 type NonBlockingHttpServer struct {
-	htdocs  string
-	wg      *sync.WaitGroup
-	server  *http.Server
-	started bool
+	htdocs     fs.FS
+	wg         *sync.WaitGroup
+	server     *http.Server
+	bootServer *http.Server
+	// the https server listens on adminListeners, the boot one on
+	// bootListeners
+	adminListeners []k8sinit.Listener
+	bootListeners  []k8sinit.Listener
+	listeners      []net.Listener
+	started        bool
+	// scopes holds the scope each route of the https router requires
+	scopes map[*mux.Route]auth.Scope
 }
 
 func fillMimes() {
@@ -43,75 +64,182 @@ func fillMimes() {
 	mime.AddExtensionType(".html", "text/html; charset=utf-8")
 }
 
-func NewNonBlockingHttpSever(htdocs string) (*NonBlockingHttpServer, error) {
+// handle adds a route which needs scope, ScopeNone for public routes. GET
+// routes answer HEAD too.
+func (s *NonBlockingHttpServer) handle(router *mux.Router, scope auth.Scope, path string, f http.HandlerFunc, method string) {
+	methods := []string{method, http.MethodOptions}
+	if method == http.MethodGet {
+		methods = append(methods, http.MethodHead)
+	}
+	route := router.HandleFunc(path, f).Methods(methods...)
+	s.scopes[route] = scope
+}
+
+// addBootRoutes adds the routes ipxe clients boot from. They are served
+// over plain http too, without authentication as ipxe cannot present a
+// token.
+func (s *NonBlockingHttpServer) addBootRoutes(router *mux.Router) {
+	for _, rt := range api.Routes() {
+		if rt.Boot {
+			s.handle(router, rt.Scope, rt.Path, rt.Handler, rt.Method)
+		}
+	}
+}
+
+func notFound(w http.ResponseWriter, r *http.Request) {
+	api.WriteError(w, api.ErrorNotFound, "no api at "+r.URL.Path)
+}
+
+// isUiRequest tells the requests for the static files of the web ui from
+// the ones for the api.
+func isUiRequest(r *http.Request, rm *mux.RouteMatch) bool {
+	return r.URL.Path != "/api" && !strings.HasPrefix(r.URL.Path, "/api/")
+}
+
+func methodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	api.WriteError(w, api.ErrorMethodNotAllowed, r.Method+" is not allowed")
+}
+
+// redirectToHttps sends requests of the plain http server other than boot
+// ones to the https server.
+func redirectToHttps(w http.ResponseWriter, r *http.Request) {
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host = r.Host
+	}
+	target := "https://" + net.JoinHostPort(host, strconv.Itoa(k8sinit.HttpsPort)) + r.URL.RequestURI()
+	http.Redirect(w, r, target, http.StatusMovedPermanently)
+}
+
+// OverrideDir returns the directory on the pool whose files are served
+// instead of the embedded ones, none when not installed.
+func OverrideDir(poolName string) string {
+	if poolName == "" {
+		return ""
+	}
+	return fmt.Sprintf("/%v/config/htdocs", poolName)
+}
+
+// overlayFS opens files of upper if they exist there, of lower otherwise.
+type overlayFS struct {
+	upper fs.FS
+	lower fs.FS
+}
+
+func (o *overlayFS) Open(name string) (fs.File, error) {
+	f, err := o.upper.Open(name)
+	if err == nil || !os.IsNotExist(err) {
+		return f, err
+	}
+	return o.lower.Open(name)
+}
+
+// listen opens a tcp listener on port of l.
+func listen(l k8sinit.Listener, port int) (net.Listener, error) {
+	lc := net.ListenConfig{}
+	if l.Device != "" {
+		device := l.Device
+		lc.Control = func(network, address string, c syscall.RawConn) error {
+			var err error
+			if cerr := c.Control(func(fd uintptr) {
+				err = unix.SetsockoptString(int(fd), unix.SOL_SOCKET, unix.SO_BINDTODEVICE, device)
+			}); cerr != nil {
+				return cerr
+			}
+			return err
+		}
+	}
+	ln, err := lc.Listen(context.Background(), "tcp", net.JoinHostPort(l.IP, strconv.Itoa(port)))
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot listen on %v port %v", l, port)
+	}
+	return ln, nil
+}
+
+// NewNonBlockingHttpSever creates the management server. The web ui is
+// embedded, files in the override directory of the pool take precedence.
+// Before install both servers listen on all addresses.
+func NewNonBlockingHttpSever(ic *k8sinit.InstallConfig, certs *pki.Pki) (*NonBlockingHttpServer, error) {
 	fillMimes()
 
-	router := mux.NewRouter()
+	overrideDir := ""
+	adminListeners := []k8sinit.Listener{{}}
+	bootListeners := []k8sinit.Listener{{}}
+	if ic != nil {
+		overrideDir = OverrideDir(ic.PoolName)
+		adminListeners = ic.AdminListeners()
+		bootListeners = ic.BootListeners()
+	}
 
-	router.HandleFunc("/api/health", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]bool{"ok": true})
-	})
+	router := mux.NewRouter()
 
 	var wg sync.WaitGroup
 
+	var files fs.FS = htdocs.Files
+	if overrideDir != "" {
+		files = &overlayFS{upper: os.DirFS(overrideDir), lower: htdocs.Files}
+	}
+
 	srv := &NonBlockingHttpServer{
-		htdocs:  htdocs,
-		wg:      &wg,
-		started: false,
-	}
-
-	router.HandleFunc("/api/disks", api.DiskApiListBlockDevices).Methods(http.MethodGet, http.MethodOptions)
-	router.HandleFunc("/api/zpools", api.DiskApiListZpools).Methods(http.MethodGet, http.MethodOptions)
-	router.HandleFunc("/api/zpools/{pool}", api.DiskApiGetZpool).Methods(http.MethodGet, http.MethodOptions)
-	router.HandleFunc("/api/zpools/{pool}/datasets", api.DiskApiListDatasets).Methods(http.MethodGet, http.MethodOptions)
-	router.HandleFunc("/api/zpools/{pool}/datasets/{dataset:.*}", api.DiskApiGetDataset).Methods(http.MethodGet, http.MethodOptions)
-	router.HandleFunc("/api/system/reboot", api.SystemApiReboot).Methods(http.MethodPost, http.MethodOptions)
-	router.HandleFunc("/api/system/poweroff", api.SystemApiPoweroff).Methods(http.MethodPost, http.MethodOptions)
-	router.HandleFunc("/api/system/install", api.SystemApiInstall).Methods(http.MethodGet, http.MethodOptions)
-	router.HandleFunc("/api/network/interfaces", api.NetworkApiInterfaceList).Methods(http.MethodGet, http.MethodOptions)
-	router.HandleFunc("/api/network/tftp", api.NetworkApiTftp).Methods(http.MethodGet, http.MethodOptions)
-	router.HandleFunc("/api/network/tftp/vmlinuz", api.NetworkApiTftpVmlinuz).Methods(http.MethodGet, http.MethodOptions)
-	router.HandleFunc("/api/network/tftp/initrd", api.NetworkApiTftpInitrd).Methods(http.MethodGet, http.MethodOptions)
-	router.PathPrefix("/").HandlerFunc(srv.defaultHandler)
-
-	router.Use(func(next http.Handler) http.Handler {
-		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			w.Header().Set("Access-Control-Allow-Origin", "*")
-			w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
-			if r.Method == http.MethodOptions {
-				return
-			}
-			next.ServeHTTP(w, r)
-		})
-	})
+		htdocs:         files,
+		wg:             &wg,
+		adminListeners: adminListeners,
+		bootListeners:  bootListeners,
+		started:        false,
+		scopes:         make(map[*mux.Route]auth.Scope),
+	}
+
+	for _, rt := range api.Routes() {
+		srv.handle(router, rt.Scope, rt.Path, rt.Handler, rt.Method)
+	}
+	router.PathPrefix("/").MatcherFunc(isUiRequest).HandlerFunc(srv.defaultHandler).Methods(http.MethodGet, http.MethodHead)
+	router.NotFoundHandler = http.HandlerFunc(notFound)
+	router.MethodNotAllowedHandler = http.HandlerFunc(methodNotAllowed)
+
+	router.Use(corsMiddleware, auditMiddleware, srv.authMiddleware)
 
 	server := &http.Server{
 		Handler:      router,
-		Addr:         "0.0.0.0:8000",
 		WriteTimeout: 15 * time.Second,
 		ReadTimeout:  15 * time.Second,
+		ConnContext:  boot.ConnContext,
+		TLSConfig: &tls.Config{
+			GetCertificate: certs.GetCertificate,
+			MinVersion:     tls.VersionTLS12,
+		},
+	}
+
+	bootRouter := mux.NewRouter()
+	srv.addBootRoutes(bootRouter)
+	bootRouter.MethodNotAllowedHandler = http.HandlerFunc(methodNotAllowed)
+	if ic == nil {
+		// the installer ui is reached on any address
+		bootRouter.PathPrefix("/").HandlerFunc(redirectToHttps)
+	}
+
+	// boot files set a write deadline per write instead of one for the
+	// whole response
+	bootServer := &http.Server{
+		Handler:     bootRouter,
+		ReadTimeout: 15 * time.Second,
+		IdleTimeout: 60 * time.Second,
+		ConnContext: boot.ConnContext,
 	}
 
 	srv.server = server
+	srv.bootServer = bootServer
 
 	return srv, nil
 }
 
 func (s *NonBlockingHttpServer) defaultHandler(w http.ResponseWriter, r *http.Request) {
-	path, err := filepath.Abs(r.URL.Path)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
-	}
+	name := strings.TrimPrefix(path.Clean("/"+r.URL.Path), "/")
 
-	if path == "" || path == "/" {
-		path = "index.html"
+	if name == "" {
+		name = "index.html"
 	}
 
-	path = filepath.Join(s.htdocs, path)
-
-	_, err = os.Stat(path)
+	_, err := fs.Stat(s.htdocs, name)
 	if os.IsNotExist(err) {
 		http.Error(w, "404 Not Found", http.StatusNotFound)
 		return
@@ -120,24 +248,64 @@ func (s *NonBlockingHttpServer) defaultHandler(w http.ResponseWriter, r *http.Re
 		return
 	}
 
-	http.FileServer(http.Dir(s.htdocs)).ServeHTTP(w, r)
+	http.FileServer(http.FS(s.htdocs)).ServeHTTP(w, r)
 }
 
-func (s *NonBlockingHttpServer) Start() {
-	s.wg.Add(1)
-	go func() {
-		defer s.wg.Done()
-		err := s.server.ListenAndServe()
-		if err != nil && err != http.ErrServerClosed {
-			klog.V(0).Error(err, "cannot start http server")
+func (s *NonBlockingHttpServer) Start() error {
+	var bootListeners []net.Listener
+	for _, l := range s.adminListeners {
+		ln, err := listen(l, k8sinit.HttpsPort)
+		if err != nil {
+			s.closeListeners()
+			return err
+		}
+		s.listeners = append(s.listeners, ln)
+	}
+	for _, l := range s.bootListeners {
+		ln, err := listen(l, k8sinit.HttpPort)
+		if err != nil {
+			s.closeListeners()
+			return err
 		}
-	}()
+		bootListeners = append(bootListeners, ln)
+		s.listeners = append(s.listeners, ln)
+	}
+	adminListeners := s.listeners[:len(s.adminListeners)]
+	s.wg.Add(len(s.listeners))
+	for _, ln := range adminListeners {
+		go func(ln net.Listener) {
+			defer s.wg.Done()
+			err := s.server.ServeTLS(ln, "", "")
+			if err != nil && err != http.ErrServerClosed {
+				klog.V(0).Error(err, "cannot start https server")
+			}
+		}(ln)
+	}
+	for _, ln := range bootListeners {
+		go func(ln net.Listener) {
+			defer s.wg.Done()
+			err := s.bootServer.Serve(ln)
+			if err != nil && err != http.ErrServerClosed {
+				klog.V(0).Error(err, "cannot start http server")
+			}
+		}(ln)
+	}
 	s.started = true
+	klog.V(0).Infof("https server started at %v, boot server at %v", s.adminListeners, s.bootListeners)
+	return nil
+}
+
+func (s *NonBlockingHttpServer) closeListeners() {
+	for _, ln := range s.listeners {
+		ln.Close()
+	}
+	s.listeners = nil
 }
 
 func (s *NonBlockingHttpServer) Stop() {
 	if s.started {
 		s.server.Shutdown(context.Background())
+		s.bootServer.Shutdown(context.Background())
 	}
 	s.Wait()
 	s.started = false
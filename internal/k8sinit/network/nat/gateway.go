@@ -0,0 +1,144 @@
+/*
+Copyright 2020 Kazım SARIKAYA
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nat
+
+import (
+	"github.com/pkg/errors"
+	"github.com/vishvananda/netns"
+	"golang.org/x/sys/unix"
+	"io/ioutil"
+	klog "k8s.io/klog/v2"
+	"net"
+	"runtime"
+)
+
+const (
+	TableName = "k8sinit"
+
+	ipForwardFile = "/proc/sys/net/ipv4/ip_forward"
+
+	// priority of the srcnat hook
+	srcNatPriority = 100
+)
+
+// GatewayConf configures masquerading of Source out of OutInterface. NetNS is
+// the path of the network namespace to configure, the current one if empty.
+type GatewayConf struct {
+	Source       *net.IPNet
+	OutInterface string
+	NetNS        string
+}
+
+// Gateway routes the internal network to the outside. It owns the nftables
+// table k8sinit.
+type Gateway struct {
+	conf GatewayConf
+}
+
+func NewGateway(conf GatewayConf) (*Gateway, error) {
+	if conf.Source == nil || conf.Source.IP.To4() == nil {
+		return nil, errors.New("nat source should be an ipv4 network")
+	}
+	if conf.OutInterface == "" || len(conf.OutInterface) >= unix.IFNAMSIZ {
+		return nil, errors.Errorf("bad nat interface %v", conf.OutInterface)
+	}
+	return &Gateway{conf: conf}, nil
+}
+
+// Enable turns on ip forwarding and replaces the k8sinit table with the
+// masquerade rule in one batch.
+func (g *Gateway) Enable() error {
+	if err := g.setForwarding(true); err != nil {
+		return err
+	}
+	b := newBatch()
+	// adding before deleting makes the delete succeed on the first run too
+	b.addTable(unix.NFPROTO_IPV4, TableName)
+	b.delTable(unix.NFPROTO_IPV4, TableName)
+	b.addTable(unix.NFPROTO_IPV4, TableName)
+	b.addBaseChain(unix.NFPROTO_IPV4, TableName, "postrouting", "nat", unix.NF_INET_POST_ROUTING, srcNatPriority)
+	ifname := make([]byte, unix.IFNAMSIZ)
+	copy(ifname, g.conf.OutInterface)
+	// ip saddr is at offset 12 of the ipv4 header
+	b.addRule(unix.NFPROTO_IPV4, TableName, "postrouting",
+		metaExpr(unix.NFT_META_OIFNAME),
+		cmpEqExpr(ifname),
+		payloadExpr(12, 4),
+		maskExpr(g.conf.Source.Mask),
+		cmpEqExpr(g.conf.Source.IP.To4().Mask(g.conf.Source.Mask)),
+		masqExpr())
+	if err := b.send(g.conf.NetNS); err != nil {
+		return errors.Wrapf(err, "cannot install nat rules")
+	}
+	klog.V(0).Infof("nat enabled for %v out of %v", g.conf.Source, g.conf.OutInterface)
+	return nil
+}
+
+// Disable removes the k8sinit table. Forwarding is left on, other routes may
+// need it.
+func (g *Gateway) Disable() error {
+	b := newBatch()
+	b.addTable(unix.NFPROTO_IPV4, TableName)
+	b.delTable(unix.NFPROTO_IPV4, TableName)
+	if err := b.send(g.conf.NetNS); err != nil {
+		return errors.Wrapf(err, "cannot remove nat rules")
+	}
+	return nil
+}
+
+// setForwarding writes the sysctl of the gateway netns. The sysctl file is
+// resolved in the netns of the thread opening it.
+func (g *Gateway) setForwarding(on bool) (err error) {
+	if g.conf.NetNS != "" {
+		runtime.LockOSThread()
+		var cur, ns netns.NsHandle
+		if cur, err = netns.Get(); err != nil {
+			runtime.UnlockOSThread()
+			return errors.Wrapf(err, "cannot get current netns")
+		}
+		defer cur.Close()
+		if ns, err = netns.GetFromPath(g.conf.NetNS); err != nil {
+			runtime.UnlockOSThread()
+			return errors.Wrapf(err, "cannot open netns %v", g.conf.NetNS)
+		}
+		defer ns.Close()
+		if err := netns.Set(ns); err != nil {
+			runtime.UnlockOSThread()
+			return errors.Wrapf(err, "cannot enter netns %v", g.conf.NetNS)
+		}
+		defer func() {
+			if rerr := netns.Set(cur); rerr != nil {
+				// a thread stuck in the gateway netns must not be
+				// unlocked, the runtime drops it when the goroutine exits
+				klog.Errorf("cannot restore netns: %v", rerr)
+				if err == nil {
+					err = errors.Wrapf(rerr, "cannot restore netns")
+				}
+				return
+			}
+			runtime.UnlockOSThread()
+		}()
+	}
+	value := "0\n"
+	if on {
+		value = "1\n"
+	}
+	if err := ioutil.WriteFile(ipForwardFile, []byte(value), 0644); err != nil {
+		return errors.Wrapf(err, "cannot set ip forwarding")
+	}
+	return nil
+}
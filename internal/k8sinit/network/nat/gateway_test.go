@@ -0,0 +1,169 @@
+/*
+Copyright 2020 Kazım SARIKAYA
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nat
+
+import (
+	"fmt"
+	"github.com/vishvananda/netlink/nl"
+	"github.com/vishvananda/netns"
+	"golang.org/x/sys/unix"
+	"io/ioutil"
+	"net"
+	"os"
+	"runtime"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// newTestNetNS creates a netns and returns a path to it which stays valid
+// until the test ends.
+func newTestNetNS(t *testing.T) string {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	cur, err := netns.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cur.Close()
+	ns, err := netns.New()
+	if err != nil {
+		t.Skipf("cannot create netns: %v", err)
+	}
+	t.Cleanup(func() { ns.Close() })
+	if err := netns.Set(cur); err != nil {
+		t.Fatal(err)
+	}
+	return fmt.Sprintf("/proc/%d/fd/%d", os.Getpid(), int(ns))
+}
+
+// nftGet asks the kernel for the nftables object named by attrs in the
+// netns at nsPath, it returns ENOENT if it does not exist.
+func nftGet(t *testing.T, nsPath string, msgType int, attrs ...*nl.RtAttr) error {
+	ns, err := netns.GetFromPath(nsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ns.Close()
+	s, err := nl.GetNetlinkSocketAt(ns, netns.None(), unix.NETLINK_NETFILTER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	req := nl.NewNetlinkRequest(msgType|unix.NFNL_SUBSYS_NFTABLES<<8, unix.NLM_F_REQUEST|unix.NLM_F_ACK)
+	req.AddData(&nfgenmsg{family: unix.NFPROTO_IPV4})
+	for _, a := range attrs {
+		req.AddData(a)
+	}
+	if err := s.Send(req); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		msgs, _, err := s.Receive()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, m := range msgs {
+			if m.Header.Type != unix.NLMSG_ERROR {
+				continue
+			}
+			if errno := int32(nl.NativeEndian().Uint32(m.Data[0:4])); errno != 0 {
+				return syscall.Errno(-errno)
+			}
+			return nil
+		}
+	}
+}
+
+func readForwarding(t *testing.T, nsPath string) string {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	cur, err := netns.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cur.Close()
+	ns, err := netns.GetFromPath(nsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ns.Close()
+	if err := netns.Set(ns); err != nil {
+		t.Fatal(err)
+	}
+	value, err := ioutil.ReadFile(ipForwardFile)
+	if err := netns.Set(cur); err != nil {
+		t.Fatal(err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.TrimSpace(string(value))
+}
+
+func TestGatewayNetNS(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("needs root")
+	}
+	nsPath := newTestNetNS(t)
+	_, source, _ := net.ParseCIDR("10.0.0.0/24")
+	g, err := NewGateway(GatewayConf{Source: source, OutInterface: "eth0", NetNS: nsPath})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	table := nl.NewRtAttr(unix.NFTA_TABLE_NAME, nl.ZeroTerminated(TableName))
+	check := func(step string, enabled bool) {
+		want := error(nil)
+		if !enabled {
+			want = syscall.ENOENT
+		}
+		if err := nftGet(t, nsPath, unix.NFT_MSG_GETTABLE, table); err != want {
+			t.Errorf("%v: table %v: %v, want %v", step, TableName, err, want)
+		}
+		if enabled {
+			err := nftGet(t, nsPath, unix.NFT_MSG_GETCHAIN,
+				nl.NewRtAttr(unix.NFTA_CHAIN_TABLE, nl.ZeroTerminated(TableName)),
+				nl.NewRtAttr(unix.NFTA_CHAIN_NAME, nl.ZeroTerminated("postrouting")))
+			if err != nil {
+				t.Errorf("%v: chain postrouting: %v", step, err)
+			}
+		}
+		// forwarding stays on after disable
+		if fwd := readForwarding(t, nsPath); fwd != "1" {
+			t.Errorf("%v: ip_forward %v, want 1", step, fwd)
+		}
+	}
+
+	if err := g.Enable(); err != nil {
+		t.Fatalf("enable: %v", err)
+	}
+	check("enable", true)
+	if err := g.Disable(); err != nil {
+		t.Fatalf("disable: %v", err)
+	}
+	check("disable", false)
+	if err := g.Enable(); err != nil {
+		t.Fatalf("enable again: %v", err)
+	}
+	check("enable again", true)
+
+	// the test process netns is untouched
+	if err := nftGet(t, "/proc/self/ns/net", unix.NFT_MSG_GETTABLE, table); err != syscall.ENOENT {
+		t.Errorf("table %v in the test netns: %v", TableName, err)
+	}
+}
@@ -0,0 +1,225 @@
+/*
+Copyright 2020 Kazım SARIKAYA
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nat
+
+import (
+	"encoding/binary"
+	"github.com/pkg/errors"
+	"github.com/vishvananda/netlink/nl"
+	"github.com/vishvananda/netns"
+	"golang.org/x/sys/unix"
+	"syscall"
+)
+
+// nfgenmsg is the header following nlmsghdr in nfnetlink messages.
+type nfgenmsg struct {
+	family uint8
+	resID  uint16
+}
+
+func (m *nfgenmsg) Len() int {
+	return 4
+}
+
+func (m *nfgenmsg) Serialize() []byte {
+	b := make([]byte, 4)
+	b[0] = m.family
+	b[1] = unix.NFNETLINK_V0
+	binary.BigEndian.PutUint16(b[2:], m.resID)
+	return b
+}
+
+// nftables attributes carry integers in network byte order.
+func be32(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v)
+	return b
+}
+
+func nested(attrType int) *nl.RtAttr {
+	return nl.NewRtAttr(attrType|unix.NLA_F_NESTED, nil)
+}
+
+// batch collects nftables messages which the kernel applies atomically.
+type batch struct {
+	msgs  [][]byte
+	acked int
+}
+
+func newBatch() *batch {
+	b := &batch{}
+	b.add(unix.NFNL_MSG_BATCH_BEGIN, unix.NLM_F_REQUEST, unix.AF_UNSPEC, false)
+	return b
+}
+
+// add appends a message. For nftables messages msgType is the message type
+// inside the nftables subsystem and an ack is requested.
+func (b *batch) add(msgType, flags int, family uint8, nft bool, attrs ...*nl.RtAttr) {
+	resID := uint16(0)
+	if nft {
+		msgType |= unix.NFNL_SUBSYS_NFTABLES << 8
+		flags |= unix.NLM_F_ACK
+		b.acked++
+	} else {
+		resID = unix.NFNL_SUBSYS_NFTABLES
+	}
+	req := nl.NewNetlinkRequest(msgType, flags)
+	req.AddData(&nfgenmsg{family: family, resID: resID})
+	for _, a := range attrs {
+		req.AddData(a)
+	}
+	b.msgs = append(b.msgs, req.Serialize())
+}
+
+// send commits the batch in the network namespace at nsPath, the current one
+// if nsPath is empty.
+func (b *batch) send(nsPath string) error {
+	b.add(unix.NFNL_MSG_BATCH_END, unix.NLM_F_REQUEST, unix.AF_UNSPEC, false)
+	ns := netns.None()
+	if nsPath != "" {
+		var err error
+		if ns, err = netns.GetFromPath(nsPath); err != nil {
+			return errors.Wrapf(err, "cannot open netns %v", nsPath)
+		}
+		defer ns.Close()
+	}
+	s, err := nl.GetNetlinkSocketAt(ns, netns.None(), unix.NETLINK_NETFILTER)
+	if err != nil {
+		return errors.Wrapf(err, "cannot open netfilter socket")
+	}
+	defer s.Close()
+	if err := s.SetReceiveTimeout(&unix.Timeval{Sec: 5}); err != nil {
+		return errors.Wrapf(err, "cannot set netfilter socket timeout")
+	}
+	var buf []byte
+	for _, m := range b.msgs {
+		buf = append(buf, m...)
+	}
+	if err := unix.Sendto(s.GetFd(), buf, 0, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		return errors.Wrapf(err, "cannot send nftables batch")
+	}
+	for acked := 0; acked < b.acked; {
+		msgs, _, err := s.Receive()
+		if err != nil {
+			return errors.Wrapf(err, "cannot receive nftables reply")
+		}
+		for _, m := range msgs {
+			if m.Header.Type != unix.NLMSG_ERROR {
+				continue
+			}
+			if errno := int32(nl.NativeEndian().Uint32(m.Data[0:4])); errno != 0 {
+				return errors.Wrapf(syscall.Errno(-errno), "nftables batch failed")
+			}
+			acked++
+		}
+	}
+	return nil
+}
+
+func (b *batch) addTable(family uint8, name string) {
+	b.add(unix.NFT_MSG_NEWTABLE, unix.NLM_F_REQUEST|unix.NLM_F_CREATE, family, true,
+		nl.NewRtAttr(unix.NFTA_TABLE_NAME, nl.ZeroTerminated(name)),
+		nl.NewRtAttr(unix.NFTA_TABLE_FLAGS, be32(0)))
+}
+
+func (b *batch) delTable(family uint8, name string) {
+	b.add(unix.NFT_MSG_DELTABLE, unix.NLM_F_REQUEST, family, true,
+		nl.NewRtAttr(unix.NFTA_TABLE_NAME, nl.ZeroTerminated(name)))
+}
+
+// addBaseChain adds a chain of chainType attached to hook.
+func (b *batch) addBaseChain(family uint8, table, name, chainType string, hook, priority uint32) {
+	h := nested(unix.NFTA_CHAIN_HOOK)
+	h.AddRtAttr(unix.NFTA_HOOK_HOOKNUM, be32(hook))
+	h.AddRtAttr(unix.NFTA_HOOK_PRIORITY, be32(priority))
+	b.add(unix.NFT_MSG_NEWCHAIN, unix.NLM_F_REQUEST|unix.NLM_F_CREATE, family, true,
+		nl.NewRtAttr(unix.NFTA_CHAIN_TABLE, nl.ZeroTerminated(table)),
+		nl.NewRtAttr(unix.NFTA_CHAIN_NAME, nl.ZeroTerminated(name)),
+		h,
+		nl.NewRtAttr(unix.NFTA_CHAIN_TYPE, nl.ZeroTerminated(chainType)))
+}
+
+func (b *batch) addRule(family uint8, table, chain string, exprs ...*nl.RtAttr) {
+	list := nested(unix.NFTA_RULE_EXPRESSIONS)
+	for _, e := range exprs {
+		list.AddChild(e)
+	}
+	b.add(unix.NFT_MSG_NEWRULE, unix.NLM_F_REQUEST|unix.NLM_F_CREATE|unix.NLM_F_APPEND, family, true,
+		nl.NewRtAttr(unix.NFTA_RULE_TABLE, nl.ZeroTerminated(table)),
+		nl.NewRtAttr(unix.NFTA_RULE_CHAIN, nl.ZeroTerminated(chain)),
+		list)
+}
+
+// expr builds a rule expression, data is nil for expressions without
+// parameters.
+func expr(name string, data *nl.RtAttr) *nl.RtAttr {
+	e := nested(unix.NFTA_LIST_ELEM)
+	e.AddRtAttr(unix.NFTA_EXPR_NAME, nl.ZeroTerminated(name))
+	if data != nil {
+		e.AddChild(data)
+	}
+	return e
+}
+
+func dataValue(attrType int, value []byte) *nl.RtAttr {
+	d := nested(attrType)
+	d.AddRtAttr(unix.NFTA_DATA_VALUE, value)
+	return d
+}
+
+// metaExpr loads the meta key into register 1.
+func metaExpr(key uint32) *nl.RtAttr {
+	d := nested(unix.NFTA_EXPR_DATA)
+	d.AddRtAttr(unix.NFTA_META_DREG, be32(unix.NFT_REG_1))
+	d.AddRtAttr(unix.NFTA_META_KEY, be32(key))
+	return expr("meta", d)
+}
+
+// payloadExpr loads size bytes at offset of the network header into
+// register 1.
+func payloadExpr(offset, size uint32) *nl.RtAttr {
+	d := nested(unix.NFTA_EXPR_DATA)
+	d.AddRtAttr(unix.NFTA_PAYLOAD_DREG, be32(unix.NFT_REG_1))
+	d.AddRtAttr(unix.NFTA_PAYLOAD_BASE, be32(unix.NFT_PAYLOAD_NETWORK_HEADER))
+	d.AddRtAttr(unix.NFTA_PAYLOAD_OFFSET, be32(offset))
+	d.AddRtAttr(unix.NFTA_PAYLOAD_LEN, be32(size))
+	return expr("payload", d)
+}
+
+// maskExpr ands register 1 with mask.
+func maskExpr(mask []byte) *nl.RtAttr {
+	d := nested(unix.NFTA_EXPR_DATA)
+	d.AddRtAttr(unix.NFTA_BITWISE_SREG, be32(unix.NFT_REG_1))
+	d.AddRtAttr(unix.NFTA_BITWISE_DREG, be32(unix.NFT_REG_1))
+	d.AddRtAttr(unix.NFTA_BITWISE_LEN, be32(uint32(len(mask))))
+	d.AddChild(dataValue(unix.NFTA_BITWISE_MASK, mask))
+	d.AddChild(dataValue(unix.NFTA_BITWISE_XOR, make([]byte, len(mask))))
+	return expr("bitwise", d)
+}
+
+// cmpEqExpr ends the rule unless register 1 equals value.
+func cmpEqExpr(value []byte) *nl.RtAttr {
+	d := nested(unix.NFTA_EXPR_DATA)
+	d.AddRtAttr(unix.NFTA_CMP_SREG, be32(unix.NFT_REG_1))
+	d.AddRtAttr(unix.NFTA_CMP_OP, be32(unix.NFT_CMP_EQ))
+	d.AddChild(dataValue(unix.NFTA_CMP_DATA, value))
+	return expr("cmp", d)
+}
+
+func masqExpr() *nl.RtAttr {
+	return expr("masq", nil)
+}
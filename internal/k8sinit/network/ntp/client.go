@@ -0,0 +1,86 @@
+/*
+Copyright 2020 Kazım SARIKAYA
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ntp
+
+import (
+	"github.com/pkg/errors"
+	"net"
+	"time"
+)
+
+// Response is the result of a query. Offset is the time to add to the local
+// clock to match the server.
+type Response struct {
+	Server         net.IP
+	Stratum        uint8
+	ReferenceID    [4]byte
+	Offset         time.Duration
+	Delay          time.Duration
+	RootDelay      time.Duration
+	RootDispersion time.Duration
+	Leap           uint8
+}
+
+func fromNtpShort(v uint32) time.Duration {
+	return time.Duration((uint64(v) * uint64(time.Second)) >> 16)
+}
+
+// Query sends one sntp request to server, host or host:port.
+func Query(server string, timeout time.Duration) (*Response, error) {
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "123")
+	}
+	conn, err := net.DialTimeout("udp", server, timeout)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot connect ntp server %v", server)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	t1 := time.Now()
+	req := &Packet{Version: Version, Mode: ModeClient, TransmitTime: ToNtpTime(t1)}
+	if _, err := conn.Write(req.ToBytes()); err != nil {
+		return nil, errors.Wrapf(err, "cannot send ntp request to %v", server)
+	}
+	buf := make([]byte, 1024)
+	for {
+		n, err := conn.Read(buf)
+		t4 := time.Now()
+		if err != nil {
+			return nil, errors.Wrapf(err, "cannot read ntp reply of %v", server)
+		}
+		reply, err := ParsePacket(buf[:n])
+		if err != nil || reply.Mode != ModeServer || reply.OriginTime != req.TransmitTime {
+			// not the answer of our request
+			continue
+		}
+		if reply.Leap == LeapNotSynced || reply.Stratum == 0 || reply.Stratum > 15 {
+			return nil, errors.Errorf("ntp server %v is not synced", server)
+		}
+		t2, t3 := FromNtpTime(reply.ReceiveTime), FromNtpTime(reply.TransmitTime)
+		return &Response{
+			Server:         conn.RemoteAddr().(*net.UDPAddr).IP,
+			Stratum:        reply.Stratum,
+			ReferenceID:    reply.ReferenceID,
+			Offset:         (t2.Sub(t1) + t3.Sub(t4)) / 2,
+			Delay:          t4.Sub(t1) - t3.Sub(t2),
+			RootDelay:      fromNtpShort(reply.RootDelay),
+			RootDispersion: fromNtpShort(reply.RootDispersion),
+			Leap:           reply.Leap,
+		}, nil
+	}
+}
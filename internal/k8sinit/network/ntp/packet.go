@@ -0,0 +1,119 @@
+/*
+Copyright 2020 Kazım SARIKAYA
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ntp
+
+import (
+	"encoding/binary"
+	"github.com/pkg/errors"
+	"time"
+)
+
+const (
+	PacketSize = 48
+
+	ModeClient = 3
+	ModeServer = 4
+
+	LeapNoWarning = 0
+	LeapNotSynced = 3
+
+	Version = 4
+
+	// seconds between the ntp era 0 and the unix epoch
+	ntpEpochOffset = 2208988800
+)
+
+var ShortPacketError = errors.New("ntp packet is too short")
+
+// Packet is the fixed part of an ntp packet, rfc 5905. Extension fields and
+// authentication are not supported.
+type Packet struct {
+	Leap           uint8
+	Version        uint8
+	Mode           uint8
+	Stratum        uint8
+	Poll           int8
+	Precision      int8
+	RootDelay      uint32
+	RootDispersion uint32
+	ReferenceID    [4]byte
+	ReferenceTime  uint64
+	OriginTime     uint64
+	ReceiveTime    uint64
+	TransmitTime   uint64
+}
+
+func ParsePacket(data []byte) (*Packet, error) {
+	if len(data) < PacketSize {
+		return nil, ShortPacketError
+	}
+	p := &Packet{
+		Leap:           data[0] >> 6,
+		Version:        (data[0] >> 3) & 0x7,
+		Mode:           data[0] & 0x7,
+		Stratum:        data[1],
+		Poll:           int8(data[2]),
+		Precision:      int8(data[3]),
+		RootDelay:      binary.BigEndian.Uint32(data[4:]),
+		RootDispersion: binary.BigEndian.Uint32(data[8:]),
+		ReferenceTime:  binary.BigEndian.Uint64(data[16:]),
+		OriginTime:     binary.BigEndian.Uint64(data[24:]),
+		ReceiveTime:    binary.BigEndian.Uint64(data[32:]),
+		TransmitTime:   binary.BigEndian.Uint64(data[40:]),
+	}
+	copy(p.ReferenceID[:], data[12:16])
+	return p, nil
+}
+
+func (p *Packet) ToBytes() []byte {
+	data := make([]byte, PacketSize)
+	data[0] = p.Leap<<6 | (p.Version&0x7)<<3 | p.Mode&0x7
+	data[1] = p.Stratum
+	data[2] = byte(p.Poll)
+	data[3] = byte(p.Precision)
+	binary.BigEndian.PutUint32(data[4:], p.RootDelay)
+	binary.BigEndian.PutUint32(data[8:], p.RootDispersion)
+	copy(data[12:16], p.ReferenceID[:])
+	binary.BigEndian.PutUint64(data[16:], p.ReferenceTime)
+	binary.BigEndian.PutUint64(data[24:], p.OriginTime)
+	binary.BigEndian.PutUint64(data[32:], p.ReceiveTime)
+	binary.BigEndian.PutUint64(data[40:], p.TransmitTime)
+	return data
+}
+
+// ToNtpTime converts t to the 64 bit ntp timestamp format.
+func ToNtpTime(t time.Time) uint64 {
+	secs := uint64(t.Unix() + ntpEpochOffset)
+	frac := (uint64(t.Nanosecond()) << 32) / 1e9
+	return secs<<32 | frac
+}
+
+// FromNtpTime converts a 64 bit ntp timestamp to time.
+func FromNtpTime(ts uint64) time.Time {
+	secs := int64(ts>>32) - ntpEpochOffset
+	nsec := (int64(ts&0xffffffff) * 1e9) >> 32
+	return time.Unix(secs, nsec)
+}
+
+// ToNtpShort converts d to the 32 bit ntp short format used by root delay
+// and dispersion.
+func ToNtpShort(d time.Duration) uint32 {
+	if d < 0 {
+		d = 0
+	}
+	return uint32((uint64(d) << 16) / uint64(time.Second))
+}
@@ -0,0 +1,246 @@
+/*
+Copyright 2020 Kazım SARIKAYA
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ntp
+
+import (
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+	klog "k8s.io/klog/v2"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// stratum and reference id announced while the manager clock is not
+	// synced, nodes still agree on the manager time
+	LocalStratum = 10
+	LocalRefID   = "LOCL"
+
+	// stratum announced while the kernel clock is synced by a source not
+	// given with SetReference
+	syncedStratum = 3
+
+	// STA_UNSYNC of adjtimex status
+	staUnsync = 0x0040
+
+	precision = -20
+)
+
+// Status is the state of the ntp server. MaxError and EstError are the
+// kernel clock errors in microseconds.
+type Status struct {
+	Running     bool   `json:"running"`
+	Synced      bool   `json:"synced"`
+	Stratum     uint8  `json:"stratum"`
+	ReferenceID string `json:"refid"`
+	MaxError    int64  `json:"maxerror"`
+	EstError    int64  `json:"esterror"`
+	Requests    uint64 `json:"requests"`
+}
+
+// reference is the upstream server the manager clock is synced to and the
+// time it was synced last.
+type reference struct {
+	server         net.IP
+	stratum        uint8
+	rootDelay      time.Duration
+	rootDispersion time.Duration
+	lastSync       time.Time
+}
+
+type NonBlockingNtpServer struct {
+	conn     net.PacketConn
+	wg       *sync.WaitGroup
+	started  bool
+	requests uint64
+	mu       sync.Mutex
+	ref      *reference
+}
+
+var singletonNtpServer *NonBlockingNtpServer = nil
+
+func NewNonBlockingNtpServer() (*NonBlockingNtpServer, error) {
+	var wg sync.WaitGroup
+	s := &NonBlockingNtpServer{
+		wg:      &wg,
+		started: false,
+	}
+	singletonNtpServer = s
+	return s, nil
+}
+
+func GetNonBlockingNtpServer() *NonBlockingNtpServer {
+	return singletonNtpServer
+}
+
+// SetReference records the upstream server the manager clock was synced to
+// at lastSync. It is announced while the kernel clock stays synced.
+func (s *NonBlockingNtpServer) SetReference(server net.IP, stratum uint8, rootDelay, rootDispersion time.Duration, lastSync time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ref = &reference{
+		server:         server,
+		stratum:        stratum,
+		rootDelay:      rootDelay,
+		rootDispersion: rootDispersion,
+		lastSync:       lastSync,
+	}
+}
+
+// Start listens on udp port 123 of ipaddr.
+func (s *NonBlockingNtpServer) Start(ipaddr string) error {
+	addr := net.JoinHostPort(ipaddr, "123")
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return errors.Wrapf(err, "cannot listen ntp %v", addr)
+	}
+	s.conn = conn
+	s.started = true
+	s.wg.Add(1)
+	go s.serve()
+	klog.V(0).Infof("ntp server started at %v", addr)
+	return nil
+}
+
+func (s *NonBlockingNtpServer) Stop() {
+	if s.started {
+		s.started = false
+		s.conn.Close()
+	}
+	s.Wait()
+}
+
+func (s *NonBlockingNtpServer) Wait() {
+	s.wg.Wait()
+}
+
+func (s *NonBlockingNtpServer) serve() {
+	defer s.wg.Done()
+	buf := make([]byte, 1024)
+	for {
+		n, peer, err := s.conn.ReadFrom(buf)
+		recv := time.Now()
+		if err != nil {
+			if s.started {
+				klog.V(0).Error(err, "ntp server stopped")
+			}
+			return
+		}
+		reply := s.handle(buf[:n], recv)
+		if reply == nil {
+			continue
+		}
+		if _, err := s.conn.WriteTo(reply, peer); err != nil {
+			klog.V(5).Error(err, "cannot send ntp reply", "peer", peer)
+		}
+	}
+}
+
+func (s *NonBlockingNtpServer) handle(data []byte, recv time.Time) []byte {
+	req, err := ParsePacket(data)
+	if err != nil {
+		return nil
+	}
+	if req.Mode != ModeClient || req.Version < 1 || req.Version > Version {
+		return nil
+	}
+	atomic.AddUint64(&s.requests, 1)
+	st, ref := s.state()
+	poll := req.Poll
+	if poll < 4 {
+		poll = 4
+	} else if poll > 17 {
+		poll = 17
+	}
+	var delay, disp time.Duration
+	// the reference time is zero while the clock was never set by a source
+	// known here
+	var refTime uint64
+	if st.Synced {
+		// the local clock of an unsynced manager is the reference itself
+		disp = time.Duration(st.MaxError) * time.Microsecond
+		if ref != nil {
+			delay = ref.rootDelay
+			disp += ref.rootDispersion
+			refTime = ToNtpTime(ref.lastSync)
+		}
+	}
+	reply := &Packet{
+		Leap:           LeapNoWarning,
+		Version:        req.Version,
+		Mode:           ModeServer,
+		Stratum:        st.Stratum,
+		Poll:           poll,
+		Precision:      precision,
+		RootDelay:      ToNtpShort(delay),
+		RootDispersion: ToNtpShort(disp),
+		ReferenceTime:  refTime,
+		OriginTime:     req.TransmitTime,
+		ReceiveTime:    ToNtpTime(recv),
+	}
+	if ref != nil {
+		copy(reply.ReferenceID[:], ref.server.To4())
+	} else {
+		copy(reply.ReferenceID[:], st.ReferenceID)
+	}
+	reply.TransmitTime = ToNtpTime(time.Now())
+	return reply.ToBytes()
+}
+
+// Status reports the stratum the server announces. It depends on the sync
+// state of the kernel clock of the manager.
+func (s *NonBlockingNtpServer) Status() Status {
+	st, _ := s.state()
+	return st
+}
+
+// state returns the status and the reference of the synced clock, if known.
+func (s *NonBlockingNtpServer) state() (Status, *reference) {
+	st := Status{
+		Running:     s.started,
+		Stratum:     LocalStratum,
+		ReferenceID: LocalRefID,
+		Requests:    atomic.LoadUint64(&s.requests),
+	}
+	var tx unix.Timex
+	state, err := unix.Adjtimex(&tx)
+	if err != nil {
+		klog.V(5).Error(err, "cannot get kernel clock state")
+		return st, nil
+	}
+	st.MaxError = int64(tx.Maxerror)
+	st.EstError = int64(tx.Esterror)
+	if state != unix.TIME_ERROR && tx.Status&staUnsync == 0 {
+		st.Synced = true
+		st.Stratum = syncedStratum
+		st.ReferenceID = ""
+		s.mu.Lock()
+		ref := s.ref
+		s.mu.Unlock()
+		if ref != nil && ref.server.To4() != nil {
+			st.Stratum = ref.stratum + 1
+			if st.Stratum > 15 {
+				st.Stratum = 15
+			}
+			st.ReferenceID = ref.server.String()
+			return st, ref
+		}
+	}
+	return st, nil
+}
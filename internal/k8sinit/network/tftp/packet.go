@@ -0,0 +1,154 @@
+/*
+Copyright 2020 Kazım SARIKAYA
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tftp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/pkg/errors"
+	"strings"
+)
+
+// opcodes of rfc 1350 and rfc 2347
+const (
+	opRRQ   uint16 = 1
+	opWRQ   uint16 = 2
+	opDATA  uint16 = 3
+	opACK   uint16 = 4
+	opERROR uint16 = 5
+	opOACK  uint16 = 6
+)
+
+// error codes of rfc 1350 and rfc 2347
+const (
+	errUndefined     uint16 = 0
+	errNotFound      uint16 = 1
+	errAccess        uint16 = 2
+	errDiskFull      uint16 = 3
+	errIllegalOp     uint16 = 4
+	errUnknownID     uint16 = 5
+	errExists        uint16 = 6
+	errOptionRefused uint16 = 8
+)
+
+const (
+	ModeOctet    = "octet"
+	ModeNetascii = "netascii"
+
+	DefaultBlockSize = 512
+	MinBlockSize     = 8
+	MaxBlockSize     = 65464
+	// rfc 7440 allows windows up to 65535 blocks, bigger ones only cause
+	// bursts the clients cannot keep up with
+	MaxWindowSize = 64
+)
+
+var MalformedPacketError = errors.New("malformed tftp packet")
+
+// request is a read or write request with the options of rfc 2347. Option
+// names are lower case.
+type request struct {
+	op       uint16
+	filename string
+	mode     string
+	options  map[string]string
+}
+
+func parseRequest(data []byte) (*request, error) {
+	if len(data) < 2 {
+		return nil, MalformedPacketError
+	}
+	req := &request{
+		op:      binary.BigEndian.Uint16(data),
+		options: make(map[string]string),
+	}
+	if req.op != opRRQ && req.op != opWRQ {
+		return nil, errors.Wrapf(MalformedPacketError, "unexpected opcode %v", req.op)
+	}
+	fields := bytes.Split(data[2:], []byte{0})
+	// the last field is the empty one after the terminating zero
+	if len(fields) < 3 || len(fields[len(fields)-1]) != 0 {
+		return nil, MalformedPacketError
+	}
+	fields = fields[:len(fields)-1]
+	if len(fields)%2 != 0 || len(fields[0]) == 0 {
+		return nil, MalformedPacketError
+	}
+	req.filename = string(fields[0])
+	req.mode = strings.ToLower(string(fields[1]))
+	for i := 2; i < len(fields); i += 2 {
+		req.options[strings.ToLower(string(fields[i]))] = string(fields[i+1])
+	}
+	return req, nil
+}
+
+func packetOp(data []byte) uint16 {
+	if len(data) < 2 {
+		return 0
+	}
+	return binary.BigEndian.Uint16(data)
+}
+
+// packetBlock returns the block number of data and ack packets.
+func packetBlock(data []byte) uint16 {
+	if len(data) < 4 {
+		return 0
+	}
+	return binary.BigEndian.Uint16(data[2:])
+}
+
+// packetError returns the message of an error packet.
+func packetError(data []byte) string {
+	if len(data) < 4 {
+		return ""
+	}
+	return strings.TrimRight(string(data[4:]), "\x00")
+}
+
+func ackPacket(block uint16) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint16(b, opACK)
+	binary.BigEndian.PutUint16(b[2:], block)
+	return b
+}
+
+// dataHeader writes the header of a data packet into the first four bytes
+// of b.
+func dataHeader(b []byte, block uint16) {
+	binary.BigEndian.PutUint16(b, opDATA)
+	binary.BigEndian.PutUint16(b[2:], block)
+}
+
+func errorPacket(code uint16, msg string) []byte {
+	b := make([]byte, 4, 5+len(msg))
+	binary.BigEndian.PutUint16(b, opERROR)
+	binary.BigEndian.PutUint16(b[2:], code)
+	b = append(b, msg...)
+	return append(b, 0)
+}
+
+func oackPacket(options map[string]string) []byte {
+	b := make([]byte, 2)
+	binary.BigEndian.PutUint16(b, opOACK)
+	for name, value := range options {
+		b = append(b, name...)
+		b = append(b, 0)
+		b = append(b, value...)
+		b = append(b, 0)
+	}
+	return b
+}
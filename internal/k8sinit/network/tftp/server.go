@@ -17,83 +17,373 @@ limitations under the License.
 package tftp
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"github.com/kazimsarikaya/k8sinit/internal/k8sinit"
-	"github.com/pin/tftp"
+	"github.com/pkg/errors"
 	"io"
 	klog "k8s.io/klog/v2"
+	"net"
+	"net/http"
 	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 )
 
 type NonBlockingTftpSever struct {
 	tftproot string
-	undi     string
-	server   *tftp.Server
+	poolDir  string
+	refresh  bool
+	pins     map[string]string
+	// uploads are stored in a directory per client under uploadDir
+	uploads     bool
+	uploadDir   string
+	uploadQuota int64
+	maxUpload   int64
+	// uploadMu guards the bytes granted to running uploads per client
+	// directory and the paths being written
+	uploadMu sync.Mutex
+	reserved map[string]int64
+	writing  map[string]bool
+	mu       sync.Mutex
+	files    map[string]*IpxeBinary
+	conn     *net.UDPConn
 	wg       *sync.WaitGroup
 	started  bool
 }
 
-func NewNonBlockingTftpSever(tftproot string) (*NonBlockingTftpSever, error) {
+var AccessViolationError = errors.New("access violation")
+
+// refreshTimeout bounds the download of an ipxe binary.
+const refreshTimeout = 5 * time.Minute
+
+var singletonTftpServer *NonBlockingTftpSever = nil
+
+// NewNonBlockingTftpSever creates the tftp server. iPXE binaries uploaded to
+// the boot dataset of the pool are preferred over the ones in the image.
+// Other files are served from the tftp root, there is none before install.
+func NewNonBlockingTftpSever(ic *k8sinit.InstallConfig) (*NonBlockingTftpSever, error) {
 	var wg sync.WaitGroup
 
 	s := &NonBlockingTftpSever{
-		tftproot: tftproot,
+		files:    make(map[string]*IpxeBinary),
+		reserved: make(map[string]int64),
+		writing:  make(map[string]bool),
 		wg:       &wg,
 		started:  false,
 	}
+	if ic != nil {
+		s.poolDir = fmt.Sprintf("/%v/boot/ipxe", ic.PoolName)
+		s.refresh = ic.IpxeRefresh
+		s.pins = ic.IpxeSums
+		s.tftproot = ic.Tftp.GetRoot(ic.PoolName)
+		s.uploads = ic.Tftp.Uploads
+		s.uploadDir = ic.Tftp.GetUploadDir(ic.PoolName)
+		s.uploadQuota = ic.Tftp.GetUploadQuota()
+		s.maxUpload = ic.Tftp.GetMaxUploadSize()
+	}
+	singletonTftpServer = s
 
-	server := tftp.NewServer(s.readHandler, nil)
-	server.SetTimeout(5 * time.Second)
+	return s, nil
+}
 
-	s.server = server
+func GetNonBlockingTftpServer() *NonBlockingTftpSever {
+	return singletonTftpServer
+}
 
-	return s, nil
+// File returns the local path of an ipxe binary if it is available.
+func (s *NonBlockingTftpSever) File(filename string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, ok := s.files[filename]
+	if !ok {
+		return "", false
+	}
+	return b.path, true
+}
+
+func (s *NonBlockingTftpSever) IpxeBinaries() []IpxeBinary {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	result := make([]IpxeBinary, 0, len(s.files))
+	for _, b := range s.files {
+		result = append(result, *b)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name < result[j].Name
+	})
+	return result
+}
+
+func (s *NonBlockingTftpSever) loadIpxeBinaries() {
+	for filename := range IpxeBinaries {
+		var b *IpxeBinary
+		var err error
+		if s.poolDir != "" {
+			if b, err = findIpxeBinary(s.poolDir, filename, IpxeSourcePool); err != nil && !os.IsNotExist(errors.Cause(err)) {
+				klog.V(0).Error(err, "ignoring uploaded "+filename)
+			}
+		}
+		if b == nil {
+			if b, err = findIpxeBinary(k8sinit.IpxeImageDir, filename, IpxeSourceImage); err != nil {
+				klog.V(0).Error(err, "cannot find "+filename)
+				continue
+			}
+		}
+		s.mu.Lock()
+		s.files[filename] = b
+		s.mu.Unlock()
+	}
 }
 
-func (s *NonBlockingTftpSever) Start(ipaddr string) {
-	undi, err := DownloadIpxeUndi(s.tftproot)
+// InstallIpxeBinary stores a replacement of an ipxe binary in the pool and
+// serves it from now on.
+func (s *NonBlockingTftpSever) InstallIpxeBinary(filename string, r io.Reader) (IpxeBinary, error) {
+	return s.installIpxeBinary(filename, r, "")
+}
+
+// installIpxeBinary installs the binary if its sha256 is want or want is
+// empty.
+func (s *NonBlockingTftpSever) installIpxeBinary(filename string, r io.Reader, want string) (IpxeBinary, error) {
+	if _, ok := IpxeBinaries[filename]; !ok {
+		return IpxeBinary{}, UnknownIpxeBinaryError
+	}
+	if s.poolDir == "" {
+		return IpxeBinary{}, k8sinit.K8SInitNotInstalledError
+	}
+	if err := os.MkdirAll(s.poolDir, 0755); err != nil {
+		return IpxeBinary{}, errors.Wrapf(err, "cannot create %v", s.poolDir)
+	}
+	path := filepath.Join(s.poolDir, filename)
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
 	if err != nil {
-		klog.V(0).Error(err, "cannot download "+k8sinit.UndiFilename)
+		return IpxeBinary{}, errors.Wrapf(err, "cannot create %v", tmp)
 	}
-	s.undi = undi
-	s.wg.Add(1)
-	go func() {
-		defer s.wg.Done()
-		err := s.server.ListenAndServe(ipaddr + ":69")
-		if err != nil {
-			klog.V(0).Error(err, "cannot start tftp server")
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(f, h), io.LimitReader(r, MaxIpxeBinarySize+1))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil && n > MaxIpxeBinarySize {
+		err = IpxeBinaryTooLargeError
+	}
+	if err != nil {
+		os.Remove(tmp)
+		if err == IpxeBinaryTooLargeError {
+			return IpxeBinary{}, err
+		}
+		return IpxeBinary{}, errors.Wrapf(err, "cannot write %v", tmp)
+	}
+	b := &IpxeBinary{Name: filename, Source: IpxeSourcePool, SHA256: hex.EncodeToString(h.Sum(nil)), path: path}
+	if want != "" && b.SHA256 != strings.ToLower(want) {
+		os.Remove(tmp)
+		return IpxeBinary{}, errors.Wrapf(ChecksumMismatchError, "%v has sha256 %v, want %v", filename, b.SHA256, want)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sums, err := readChecksums(s.poolDir)
+	if err != nil {
+		sums = make(map[string]string)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return IpxeBinary{}, errors.Wrapf(err, "cannot replace %v", path)
+	}
+	sums[filename] = b.SHA256
+	if err := writeChecksums(s.poolDir, sums); err != nil {
+		return IpxeBinary{}, errors.Wrapf(err, "cannot write checksums of %v", s.poolDir)
+	}
+	s.files[filename] = b
+	klog.V(0).Infof("%v installed with sha256 %v", filename, b.SHA256)
+	return *b, nil
+}
+
+// refreshIpxeBinaries downloads the latest ipxe binaries into the pool. Only
+// binaries with a pinned sha256 are refreshed and a download is installed
+// only if it matches the pin. Failures keep the binaries being served.
+func (s *NonBlockingTftpSever) refreshIpxeBinaries() {
+	for filename, url := range IpxeBinaries {
+		want, ok := s.pins[filename]
+		if !ok {
+			klog.V(0).Infof("not refreshing %v, its sha256 is not pinned", filename)
+			continue
+		}
+		if err := s.refreshIpxeBinary(filename, url, want); err != nil {
+			klog.V(0).Error(err, "cannot refresh "+filename)
+		}
+	}
+}
+
+func (s *NonBlockingTftpSever) refreshIpxeBinary(filename, url, want string) error {
+	if !strings.HasPrefix(url, "https://") {
+		return errors.Errorf("refusing to download %v without tls", url)
+	}
+	client := &http.Client{Timeout: refreshTimeout}
+	resp, err := client.Get(url)
+	if err != nil {
+		return errors.Wrapf(err, "cannot get %v", url)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("cannot get %v: %v", url, resp.Status)
+	}
+	_, err = s.installIpxeBinary(filename, resp.Body, want)
+	return err
+}
+
+func (s *NonBlockingTftpSever) Start(ipaddr string) error {
+	s.loadIpxeBinaries()
+	if s.refresh && s.poolDir != "" {
+		go s.refreshIpxeBinaries()
+	}
+	if s.tftproot != "" {
+		if err := os.MkdirAll(s.tftproot, 0755); err != nil {
+			return errors.Wrapf(err, "cannot create tftp root %v", s.tftproot)
 		}
-	}()
+	}
+	addr := &net.UDPAddr{IP: net.ParseIP(ipaddr), Port: 69}
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return errors.Wrapf(err, "cannot listen tftp %v", addr)
+	}
+	s.conn = conn
 	s.started = true
+	s.wg.Add(1)
+	go s.serve()
+	klog.V(0).Infof("tftp server started at %v, root %v", addr, s.tftproot)
+	return nil
 }
 
 func (s *NonBlockingTftpSever) Stop() {
 	if s.started {
-		s.server.Shutdown()
+		s.started = false
+		s.conn.Close()
 	}
 	s.Wait()
-	s.started = false
 }
 
 func (s *NonBlockingTftpSever) Wait() {
 	s.wg.Wait()
 }
 
-func (s *NonBlockingTftpSever) readHandler(filename string, rf io.ReaderFrom) error {
-	if filename != k8sinit.UndiFilename {
-		return fmt.Errorf("only %s supported", k8sinit.UndiFilename)
+func (s *NonBlockingTftpSever) serve() {
+	defer s.wg.Done()
+	localIP := s.conn.LocalAddr().(*net.UDPAddr).IP
+	for {
+		buf := make([]byte, 1500)
+		n, peer, err := s.conn.ReadFromUDP(buf)
+		if err != nil {
+			if s.started {
+				klog.V(0).Error(err, "tftp server stopped")
+			}
+			return
+		}
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.handle(localIP, peer, buf[:n])
+		}()
 	}
-	file, err := os.Open(s.undi)
+}
+
+// handle serves a request on a new socket and logs the transfer.
+func (s *NonBlockingTftpSever) handle(localIP net.IP, peer *net.UDPAddr, data []byte) {
+	req, err := parseRequest(data)
 	if err != nil {
-		klog.V(5).Error(err, "cannot open undi pxe file")
-		return err
+		klog.V(5).Error(err, "bad tftp request", "client", peer)
+		s.conn.WriteToUDP(errorPacket(errIllegalOp, "bad request"), peer)
+		return
 	}
-	_, err = rf.ReadFrom(file)
+	t, err := newTransfer(localIP, peer, req.filename)
 	if err != nil {
-		klog.V(5).Error(err, "cannot send undi pxe file")
-		return err
+		klog.V(0).Error(err, "cannot start tftp transfer", "client", peer, "file", req.filename)
+		return
 	}
-	return nil
+	defer t.close()
+
+	switch {
+	case req.mode != ModeOctet && req.mode != ModeNetascii:
+		t.sendError(errIllegalOp, "unsupported mode")
+		err = errors.Errorf("unsupported mode %v", req.mode)
+	case req.op == opWRQ:
+		// uploads are stored as sent, netascii is not converted back
+		var path string
+		var limit int64
+		var release func()
+		if path, limit, release, err = s.uploadPath(peer.IP, req.filename); err != nil {
+			switch errors.Cause(err) {
+			case UploadQuotaExceededError:
+				t.sendError(errDiskFull, "upload quota exceeded")
+			case UploadBusyError:
+				t.sendError(errExists, err.Error())
+			case UploadsDisabledError, BadUploadNameError:
+				t.sendError(errAccess, err.Error())
+			default:
+				t.sendError(errUndefined, "cannot store upload")
+			}
+		} else {
+			err = t.receiveFile(req, path, limit)
+			release()
+		}
+	default:
+		var path string
+		if path, err = s.resolve(req.filename); err != nil {
+			if errors.Cause(err) == AccessViolationError {
+				t.sendError(errAccess, "access violation")
+			} else {
+				t.sendError(errNotFound, "file not found")
+			}
+		} else {
+			err = t.sendFile(req, path)
+		}
+	}
+	kv := []interface{}{"client", peer, "file", req.filename, "bytes", t.bytes,
+		"duration", time.Since(t.start), "blksize", t.blksize, "windowsize", t.windowsize}
+	if err != nil {
+		klog.V(0).Error(err, "tftp transfer failed", kv...)
+		return
+	}
+	if req.op == opWRQ {
+		klog.V(0).InfoS("tftp upload done", kv...)
+		return
+	}
+	klog.V(0).InfoS("tftp transfer done", kv...)
+}
+
+// resolve maps a requested filename to a file. The ipxe binaries are served
+// by name, anything else must be a regular file under the tftp root.
+func (s *NonBlockingTftpSever) resolve(filename string) (string, error) {
+	// pxe clients of some vendors use backslashes
+	name := filepath.Clean("/" + strings.ReplaceAll(filename, "\\", "/"))
+	if path, ok := s.File(strings.TrimPrefix(name, "/")); ok {
+		return path, nil
+	}
+	if s.tftproot == "" || name == "/" {
+		return "", os.ErrNotExist
+	}
+	root, err := filepath.EvalSymlinks(s.tftproot)
+	if err != nil {
+		return "", err
+	}
+	path, err := filepath.EvalSymlinks(filepath.Join(root, name))
+	if err != nil {
+		return "", err
+	}
+	// symlinks must not lead out of the root either
+	if !strings.HasPrefix(path, root+"/") {
+		return "", errors.Wrapf(AccessViolationError, "%v", filename)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	if !fi.Mode().IsRegular() {
+		return "", errors.Wrapf(AccessViolationError, "%v is not a regular file", filename)
+	}
+	return path, nil
 }
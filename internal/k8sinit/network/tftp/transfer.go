@@ -0,0 +1,377 @@
+/*
+Copyright 2020 Kazım SARIKAYA
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tftp
+
+import (
+	"bytes"
+	"github.com/pkg/errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+const (
+	DefaultTimeout = 5 * time.Second
+	maxRetries     = 5
+)
+
+// transfer is a single tftp transfer over its own socket, the port of the
+// socket is the transfer id of the server.
+type transfer struct {
+	conn       *net.UDPConn
+	peer       *net.UDPAddr
+	filename   string
+	blksize    int
+	windowsize int
+	timeout    time.Duration
+	bytes      int64
+	start      time.Time
+}
+
+func newTransfer(localIP net.IP, peer *net.UDPAddr, filename string) (*transfer, error) {
+	conn, err := net.DialUDP("udp", &net.UDPAddr{IP: localIP}, peer)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot open transfer socket for %v", peer)
+	}
+	t := &transfer{
+		conn:       conn,
+		peer:       peer,
+		filename:   filename,
+		blksize:    DefaultBlockSize,
+		windowsize: 1,
+		timeout:    DefaultTimeout,
+		start:      time.Now(),
+	}
+	return t, nil
+}
+
+func (t *transfer) close() {
+	t.conn.Close()
+}
+
+func (t *transfer) sendError(code uint16, msg string) {
+	t.conn.Write(errorPacket(code, msg))
+}
+
+// negotiate accepts the options of req the server supports and returns the
+// ones to acknowledge. size is the transfer size for tsize, -1 if unknown.
+func (t *transfer) negotiate(req *request, size int64) map[string]string {
+	oack := make(map[string]string)
+	for name, value := range req.options {
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			continue
+		}
+		switch name {
+		case "blksize":
+			if n < MinBlockSize {
+				continue
+			}
+			if n > MaxBlockSize {
+				n = MaxBlockSize
+			}
+			t.blksize = n
+			oack[name] = strconv.Itoa(n)
+		case "windowsize":
+			if n < 1 || n > 65535 {
+				continue
+			}
+			if n > MaxWindowSize {
+				n = MaxWindowSize
+			}
+			t.windowsize = n
+			oack[name] = strconv.Itoa(n)
+		case "timeout":
+			if n < 1 || n > 255 {
+				continue
+			}
+			t.timeout = time.Duration(n) * time.Second
+			oack[name] = strconv.Itoa(n)
+		case "tsize":
+			if size < 0 {
+				continue
+			}
+			oack[name] = strconv.FormatInt(size, 10)
+		}
+	}
+	return oack
+}
+
+// read waits for a packet of the peer. Error packets are returned as
+// errors.
+func (t *transfer) read(buf []byte) ([]byte, error) {
+	t.conn.SetReadDeadline(time.Now().Add(t.timeout))
+	n, err := t.conn.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	if packetOp(buf[:n]) == opERROR {
+		return nil, errors.Errorf("aborted by client: %v", packetError(buf[:n]))
+	}
+	return buf[:n], nil
+}
+
+func isTimeout(err error) bool {
+	nerr, ok := err.(net.Error)
+	return ok && nerr.Timeout()
+}
+
+// sendOack sends the option acknowledgement of a read request and waits for
+// its ack.
+func (t *transfer) sendOack(oack map[string]string) error {
+	pkt := oackPacket(oack)
+	buf := make([]byte, 516)
+	for retry := 0; retry < maxRetries; retry++ {
+		if _, err := t.conn.Write(pkt); err != nil {
+			return errors.Wrapf(err, "cannot send oack")
+		}
+		for {
+			data, err := t.read(buf)
+			if isTimeout(err) {
+				break
+			} else if err != nil {
+				return err
+			}
+			if packetOp(data) == opACK && packetBlock(data) == 0 {
+				return nil
+			}
+		}
+	}
+	return errors.New("oack is not acknowledged")
+}
+
+// send sends size bytes of r in windows of blocks. Each window is sent
+// again until its last block or an earlier one is acknowledged.
+func (t *transfer) send(r io.ReaderAt, size int64) error {
+	// the last block is shorter than blksize, empty if size is a multiple
+	// of it
+	nblocks := size/int64(t.blksize) + 1
+	pkt := make([]byte, 4+t.blksize)
+	buf := make([]byte, 516)
+	var acked int64
+	retries := 0
+	for acked < nblocks {
+		end := acked + int64(t.windowsize)
+		if end > nblocks {
+			end = nblocks
+		}
+		for block := acked + 1; block <= end; block++ {
+			n, err := r.ReadAt(pkt[4:], (block-1)*int64(t.blksize))
+			if err != nil && err != io.EOF {
+				t.sendError(errUndefined, "read error")
+				return errors.Wrapf(err, "cannot read block %v", block)
+			}
+			// block numbers wrap around after 65535 blocks
+			dataHeader(pkt, uint16(block))
+			if _, err := t.conn.Write(pkt[:4+n]); err != nil {
+				return errors.Wrapf(err, "cannot send block %v", block)
+			}
+		}
+		progressed := false
+		for !progressed {
+			data, err := t.read(buf)
+			if isTimeout(err) {
+				break
+			} else if err != nil {
+				return err
+			}
+			if packetOp(data) != opACK {
+				continue
+			}
+			// the ack is relative to the last acked block, earlier
+			// duplicates are far behind
+			block := acked + int64(packetBlock(data)-uint16(acked))
+			if block > end {
+				continue
+			}
+			if block > acked {
+				t.bytes = block * int64(t.blksize)
+				acked = block
+				progressed = true
+			} else if t.windowsize > 1 {
+				// rfc 7440: the client lost a block of the window and
+				// acknowledged the blocks before it
+				progressed = true
+			}
+		}
+		if progressed {
+			retries = 0
+		} else if retries++; retries >= maxRetries {
+			return errors.Errorf("block %v is not acknowledged", acked+1)
+		}
+	}
+	t.bytes = size
+	return nil
+}
+
+// netasciiReader converts the text file at path to netascii, lines end with
+// CR LF and bare carriage returns are followed by NUL.
+func netasciiReader(path string) (*bytes.Reader, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	for _, c := range data {
+		switch c {
+		case '\n':
+			buf.WriteString("\r\n")
+		case '\r':
+			buf.WriteString("\r\x00")
+		default:
+			buf.WriteByte(c)
+		}
+	}
+	return bytes.NewReader(buf.Bytes()), nil
+}
+
+// sendFile serves a read request for the file at path.
+func (t *transfer) sendFile(req *request, path string) error {
+	var r io.ReaderAt
+	var size int64
+	if req.mode == ModeNetascii {
+		nr, err := netasciiReader(path)
+		if err != nil {
+			t.sendError(errNotFound, "file not found")
+			return err
+		}
+		r, size = nr, nr.Size()
+	} else {
+		f, err := os.Open(path)
+		if err != nil {
+			t.sendError(errNotFound, "file not found")
+			return err
+		}
+		defer f.Close()
+		fi, err := f.Stat()
+		if err != nil {
+			t.sendError(errUndefined, "cannot stat file")
+			return err
+		}
+		r, size = f, fi.Size()
+	}
+	if oack := t.negotiate(req, size); len(oack) > 0 {
+		if err := t.sendOack(oack); err != nil {
+			return err
+		}
+	}
+	return t.send(r, size)
+}
+
+// receive writes the data sent by the peer to w, at most limit bytes. first
+// is the packet answering the write request, it is sent again until data
+// arrives. Blocks are acknowledged at the end of each window.
+func (t *transfer) receive(w io.Writer, first []byte, limit int64) error {
+	pkt := first
+	if _, err := t.conn.Write(pkt); err != nil {
+		return errors.Wrapf(err, "cannot answer write request")
+	}
+	buf := make([]byte, 4+t.blksize)
+	var received int64
+	inWindow := 0
+	retries := 0
+	for {
+		data, err := t.read(buf)
+		if isTimeout(err) {
+			if retries++; retries >= maxRetries {
+				return errors.Errorf("block %v is not received", received+1)
+			}
+			t.conn.Write(pkt)
+			inWindow = 0
+			continue
+		} else if err != nil {
+			return err
+		}
+		if packetOp(data) != opDATA {
+			continue
+		}
+		block := received + int64(packetBlock(data)-uint16(received))
+		if block != received+1 {
+			// a duplicate or a block after a lost one, acknowledge what
+			// is received so far
+			pkt = ackPacket(uint16(received))
+			t.conn.Write(pkt)
+			inWindow = 0
+			continue
+		}
+		retries = 0
+		payload := data[4:]
+		if t.bytes+int64(len(payload)) > limit {
+			t.sendError(errDiskFull, "upload quota exceeded")
+			return UploadQuotaExceededError
+		}
+		if _, err := w.Write(payload); err != nil {
+			t.sendError(errDiskFull, "write error")
+			return errors.Wrapf(err, "cannot write block %v", block)
+		}
+		t.bytes += int64(len(payload))
+		received = block
+		inWindow++
+		last := len(payload) < t.blksize
+		if inWindow == t.windowsize || last {
+			pkt = ackPacket(uint16(received))
+			if _, err := t.conn.Write(pkt); err != nil {
+				return errors.Wrapf(err, "cannot acknowledge block %v", block)
+			}
+			inWindow = 0
+		}
+		if last {
+			return nil
+		}
+	}
+}
+
+// receiveFile serves a write request, the file is replaced at path once the
+// upload is complete.
+func (t *transfer) receiveFile(req *request, path string, limit int64) error {
+	size := int64(-1)
+	if v, ok := req.options["tsize"]; ok {
+		if n, err := strconv.ParseInt(v, 10, 64); err == nil && n >= 0 {
+			size = n
+		}
+	}
+	if size > limit {
+		t.sendError(errDiskFull, "upload quota exceeded")
+		return UploadQuotaExceededError
+	}
+	first := ackPacket(0)
+	if oack := t.negotiate(req, size); len(oack) > 0 {
+		first = oackPacket(oack)
+	}
+	f, err := ioutil.TempFile(filepath.Dir(path), ".upload-")
+	if err != nil {
+		t.sendError(errAccess, "cannot create file")
+		return errors.Wrapf(err, "cannot create upload file")
+	}
+	tmp := f.Name()
+	err = t.receive(f, first, limit)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,167 @@
+/*
+Copyright 2020 Kazım SARIKAYA
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tftp
+
+import (
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	UploadsDisabledError     = errors.New("tftp uploads are disabled")
+	UploadQuotaExceededError = errors.New("tftp upload quota exceeded")
+	BadUploadNameError       = errors.New("bad upload name")
+	UploadBusyError          = errors.New("file is being uploaded")
+)
+
+// Upload is a file a tftp client wrote into its upload directory. Client is
+// the address of the client which names the directory.
+type Upload struct {
+	Client  string    `json:"client"`
+	Name    string    `json:"name"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modtime"`
+}
+
+// uploadName checks that name is a plain file name, uploads cannot create
+// directories.
+func uploadName(name string) (string, error) {
+	name = strings.TrimPrefix(strings.ReplaceAll(name, "\\", "/"), "/")
+	if name == "" || name == "." || name == ".." || strings.Contains(name, "/") || strings.HasPrefix(name, ".upload-") {
+		return "", errors.Wrapf(BadUploadNameError, "%v", name)
+	}
+	return name, nil
+}
+
+// uploadPath returns where the upload of client is stored and how many bytes
+// it may have. The bytes are reserved from the quota of the client until
+// release is called at the end of the transfer, so parallel uploads cannot
+// exceed it together. A file is written by one upload at a time.
+func (s *NonBlockingTftpSever) uploadPath(client net.IP, filename string) (string, int64, func(), error) {
+	if !s.uploads || s.uploadDir == "" {
+		return "", 0, nil, UploadsDisabledError
+	}
+	name, err := uploadName(filename)
+	if err != nil {
+		return "", 0, nil, err
+	}
+	dir := filepath.Join(s.uploadDir, client.String())
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return "", 0, nil, errors.Wrapf(err, "cannot create %v", dir)
+	}
+	path := filepath.Join(dir, name)
+
+	s.uploadMu.Lock()
+	defer s.uploadMu.Unlock()
+	if s.writing[path] {
+		return "", 0, nil, errors.Wrapf(UploadBusyError, "%v", name)
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return "", 0, nil, errors.Wrapf(err, "cannot read %v", dir)
+	}
+	// the file being replaced does not count, running uploads count with
+	// the bytes reserved for them instead of their temp files
+	used := s.reserved[dir]
+	for _, fi := range files {
+		if fi.Mode().IsRegular() && fi.Name() != name && !strings.HasPrefix(fi.Name(), ".upload-") {
+			used += fi.Size()
+		}
+	}
+	limit := s.uploadQuota - used
+	if limit > s.maxUpload {
+		limit = s.maxUpload
+	}
+	if limit <= 0 {
+		return "", 0, nil, UploadQuotaExceededError
+	}
+	s.reserved[dir] += limit
+	s.writing[path] = true
+	release := func() {
+		s.uploadMu.Lock()
+		defer s.uploadMu.Unlock()
+		if s.reserved[dir] -= limit; s.reserved[dir] <= 0 {
+			delete(s.reserved, dir)
+		}
+		delete(s.writing, path)
+	}
+	return path, limit, release, nil
+}
+
+// Uploads lists the files uploaded by the tftp clients.
+func (s *NonBlockingTftpSever) Uploads() ([]Upload, error) {
+	result := []Upload{}
+	if s.uploadDir == "" {
+		return result, nil
+	}
+	clients, err := ioutil.ReadDir(s.uploadDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return result, nil
+		}
+		return nil, errors.Wrapf(err, "cannot read %v", s.uploadDir)
+	}
+	for _, c := range clients {
+		if !c.IsDir() {
+			continue
+		}
+		files, err := ioutil.ReadDir(filepath.Join(s.uploadDir, c.Name()))
+		if err != nil {
+			return nil, errors.Wrapf(err, "cannot read uploads of %v", c.Name())
+		}
+		for _, fi := range files {
+			if !fi.Mode().IsRegular() || strings.HasPrefix(fi.Name(), ".upload-") {
+				continue
+			}
+			result = append(result, Upload{Client: c.Name(), Name: fi.Name(), Size: fi.Size(), ModTime: fi.ModTime()})
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Client != result[j].Client {
+			return result[i].Client < result[j].Client
+		}
+		return result[i].Name < result[j].Name
+	})
+	return result, nil
+}
+
+// UploadFile returns the local path of an upload of client.
+func (s *NonBlockingTftpSever) UploadFile(client, filename string) (string, error) {
+	ip := net.ParseIP(client)
+	if ip == nil || s.uploadDir == "" {
+		return "", os.ErrNotExist
+	}
+	name, err := uploadName(filename)
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(s.uploadDir, ip.String(), name)
+	fi, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	if !fi.Mode().IsRegular() {
+		return "", os.ErrNotExist
+	}
+	return path, nil
+}
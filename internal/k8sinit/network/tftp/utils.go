@@ -17,30 +17,120 @@ limitations under the License.
 package tftp
 
 import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
 	"github.com/kazimsarikaya/k8sinit/internal/k8sinit"
 	"github.com/pkg/errors"
 	"io"
-	"net/http"
 	"os"
+	"path/filepath"
+	"strings"
 )
 
-func DownloadIpxeUndi(tftproot string) (string, error) {
-	resp, err := http.Get(k8sinit.UndiUrl)
+const (
+	ChecksumsFilename = "SHA256SUMS"
+
+	IpxeSourcePool  = "pool"
+	IpxeSourceImage = "image"
+
+	// MaxIpxeBinarySize limits uploaded and downloaded ipxe binaries.
+	MaxIpxeBinarySize = 16 << 20
+)
+
+var (
+	UnknownIpxeBinaryError  = errors.New("unknown ipxe binary")
+	ChecksumMismatchError   = errors.New("checksum mismatch")
+	IpxeBinaryTooLargeError = errors.New("ipxe binary too large")
+)
+
+// IpxeBinaries maps the ipxe binaries served to pxe clients to their
+// download urls.
+var IpxeBinaries = map[string]string{
+	k8sinit.UndiFilename:         k8sinit.UndiUrl,
+	k8sinit.IpxeEfiFilename:      k8sinit.IpxeEfiUrl,
+	k8sinit.IpxeArm64EfiFilename: k8sinit.IpxeArm64EfiUrl,
+}
+
+// IpxeBinary is an ipxe binary being served. Source tells whether it is
+// shipped in the image or uploaded to the pool.
+type IpxeBinary struct {
+	Name   string `json:"name"`
+	Source string `json:"source"`
+	SHA256 string `json:"sha256"`
+	path   string
+}
+
+// readChecksums parses the sha256sum manifest of dir.
+func readChecksums(dir string) (map[string]string, error) {
+	f, err := os.Open(filepath.Join(dir, ChecksumsFilename))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	result := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		result[strings.TrimPrefix(fields[1], "*")] = strings.ToLower(fields[0])
+	}
+	return result, scanner.Err()
+}
+
+// writeChecksums replaces the manifest of dir.
+func writeChecksums(dir string, sums map[string]string) error {
+	file := filepath.Join(dir, ChecksumsFilename)
+	tmp := file + ".tmp"
+	f, err := os.Create(tmp)
 	if err != nil {
-		return "", errors.Wrapf(err, "cannot get undi pxe")
+		return errors.Wrapf(err, "cannot create %v", tmp)
 	}
-	defer resp.Body.Close()
+	for name, sum := range sums {
+		if _, err := f.WriteString(sum + "  " + name + "\n"); err != nil {
+			f.Close()
+			return errors.Wrapf(err, "cannot write %v", tmp)
+		}
+	}
+	if err := f.Close(); err != nil {
+		return errors.Wrapf(err, "cannot write %v", tmp)
+	}
+	return os.Rename(tmp, file)
+}
 
-	filepath := tftproot + "/" + k8sinit.UndiFilename
-	out, err := os.Create(filepath)
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
 	if err != nil {
-		return "", errors.Wrapf(err, "cannot create local undi pxe")
+		return "", err
 	}
-	defer out.Close()
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
 
-	_, err = io.Copy(out, resp.Body)
+// findIpxeBinary returns filename of dir if the manifest of dir lists it with
+// the checksum of the file.
+func findIpxeBinary(dir, filename, source string) (*IpxeBinary, error) {
+	sums, err := readChecksums(dir)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot read checksums of %v", dir)
+	}
+	want, ok := sums[filename]
+	if !ok {
+		return nil, errors.Errorf("no checksum of %v in %v", filename, dir)
+	}
+	path := filepath.Join(dir, filename)
+	got, err := fileSHA256(path)
 	if err != nil {
-		return "", errors.Wrapf(err, "cannot download undi pxe")
+		return nil, errors.Wrapf(err, "cannot read %v", path)
+	}
+	if got != want {
+		return nil, errors.Wrapf(ChecksumMismatchError, "%v", path)
 	}
-	return filepath, nil
+	return &IpxeBinary{Name: filename, Source: source, SHA256: got, path: path}, nil
 }
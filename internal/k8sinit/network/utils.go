@@ -23,9 +23,12 @@ import (
 	"github.com/kazimsarikaya/k8sinit/internal/k8sinit"
 	"github.com/pkg/errors"
 	"github.com/vishvananda/netlink"
+	"io/ioutil"
 	klog "k8s.io/klog/v2"
 	"net"
 	"os/exec"
+	"path/filepath"
+	"strings"
 )
 
 func GetInterfaces() ([]string, error) {
@@ -68,8 +71,40 @@ func InterfaceUp(ifname string) error {
 	return nil
 }
 
+const (
+	udhcpcScript        = "/run/udhcpc.script"
+	udhcpcDefaultScript = "/usr/share/udhcpc/default.script"
+)
+
+// udhcpcScriptContent keeps the ntp servers sent by the dhcp server while the
+// lease lasts, then runs the default script.
+var udhcpcScriptContent = `#!/bin/sh
+ntpfile=/run/udhcpc.$interface.ntp
+case "$1" in
+  bound|renew)
+    if [ -n "$ntpsrv" ]; then
+      echo $ntpsrv > $ntpfile
+    else
+      rm -f $ntpfile
+    fi
+    ;;
+  deconfig|leasefail|nak)
+    rm -f $ntpfile
+    ;;
+esac
+exec ` + udhcpcDefaultScript + ` "$@"
+`
+
+// InterfaceDhcp starts udhcpc on ifname in the background. Without the
+// script keeping ntp servers the default one is used.
 func InterfaceDhcp(ifname string) error {
-	cmd := exec.Command("/sbin/udhcpc", "-i", ifname, "-b", "-p", fmt.Sprintf("/run/udhcpc.%s.pid", ifname))
+	script := udhcpcScript
+	if err := ioutil.WriteFile(udhcpcScript, []byte(udhcpcScriptContent), 0755); err != nil {
+		klog.V(0).Error(err, "cannot write udhcpc script, ntp servers of dhcp are ignored")
+		script = udhcpcDefaultScript
+	}
+	cmd := exec.Command("/sbin/udhcpc", "-i", ifname, "-b", "-p", fmt.Sprintf("/run/udhcpc.%s.pid", ifname),
+		"-O", "ntpsrv", "-s", script)
 	var out bytes.Buffer
 	cmd.Stdout = &out
 	cmd.Stderr = &out
@@ -207,3 +242,21 @@ func Int2Ip(nn uint32) net.IP {
 	binary.BigEndian.PutUint32(ip, nn)
 	return ip
 }
+
+// DhcpNtpServers returns the ntp servers the dhcp servers of all interfaces
+// sent.
+func DhcpNtpServers() []string {
+	files, err := filepath.Glob("/run/udhcpc.*.ntp")
+	if err != nil {
+		return nil
+	}
+	var result []string
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			continue
+		}
+		result = append(result, strings.Fields(string(data))...)
+	}
+	return result
+}
@@ -0,0 +1,384 @@
+/*
+Copyright 2020 Kazım SARIKAYA
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pki
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	klog "k8s.io/klog/v2"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	CACertFilename = "ca.crt"
+	CAKeyFilename  = "ca.key"
+	CertFilename   = "server.crt"
+	KeyFilename    = "server.key"
+
+	// RuntimeDir keeps the certificates until the system is installed
+	RuntimeDir = "/run/k8sinit/tls"
+
+	caValidity   = 10 * 365 * 24 * time.Hour
+	certValidity = 397 * 24 * time.Hour
+)
+
+var (
+	InvalidCertificateError = errors.New("invalid certificate")
+	PkiNotReadyError        = errors.New("pki is not ready")
+)
+
+// CertificateInfo describes a certificate for the api.
+type CertificateInfo struct {
+	Subject     string    `json:"subject"`
+	Issuer      string    `json:"issuer"`
+	DNSNames    []string  `json:"dnsnames"`
+	IPAddresses []string  `json:"ipaddresses"`
+	NotBefore   time.Time `json:"notbefore"`
+	NotAfter    time.Time `json:"notafter"`
+	SHA256      string    `json:"sha256"`
+}
+
+// Pki holds the on-box ca and the server certificate of the management
+// http server. The server certificate can be rotated or replaced while it is
+// in use.
+type Pki struct {
+	dir   string
+	mu    sync.RWMutex
+	ca    *x509.Certificate
+	caKey crypto.Signer
+	caPEM []byte
+	cert  *tls.Certificate
+}
+
+var singletonPki *Pki = nil
+
+// Dir returns the certificate directory of the pool, the runtime one when
+// not installed.
+func Dir(poolName string) string {
+	if poolName == "" {
+		return RuntimeDir
+	}
+	return fmt.Sprintf("/%v/config/tls", poolName)
+}
+
+// NewOrGetPki loads the ca and the server certificate from dir, creating the
+// missing ones.
+func NewOrGetPki(dir string) (*Pki, error) {
+	if singletonPki != nil {
+		return singletonPki, nil
+	}
+	p := &Pki{dir: dir}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, errors.Wrapf(err, "cannot create %v", dir)
+	}
+	if err := p.loadCA(); err != nil {
+		if !os.IsNotExist(errors.Cause(err)) {
+			return nil, err
+		}
+		if err := p.createCA(); err != nil {
+			return nil, err
+		}
+	}
+	cert, err := tls.LoadX509KeyPair(p.path(CertFilename), p.path(KeyFilename))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			klog.V(0).Error(err, "cannot load server certificate, creating a new one")
+		}
+		if _, err := p.RotateServerCertificate(); err != nil {
+			return nil, err
+		}
+	} else {
+		p.cert = &cert
+	}
+	singletonPki = p
+	return p, nil
+}
+
+func GetPki() *Pki {
+	return singletonPki
+}
+
+func (p *Pki) path(filename string) string {
+	return filepath.Join(p.dir, filename)
+}
+
+func (p *Pki) loadCA() error {
+	caPEM, err := ioutil.ReadFile(p.path(CACertFilename))
+	if err != nil {
+		return errors.Wrapf(err, "cannot read ca certificate")
+	}
+	keyPEM, err := ioutil.ReadFile(p.path(CAKeyFilename))
+	if err != nil {
+		return errors.Wrapf(err, "cannot read ca key")
+	}
+	pair, err := tls.X509KeyPair(caPEM, keyPEM)
+	if err != nil {
+		return errors.Wrapf(err, "cannot load ca")
+	}
+	ca, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return errors.Wrapf(err, "cannot parse ca certificate")
+	}
+	signer, ok := pair.PrivateKey.(crypto.Signer)
+	if !ok || !ca.IsCA {
+		return errors.Wrapf(InvalidCertificateError, "%v is not a ca", p.path(CACertFilename))
+	}
+	p.ca, p.caKey, p.caPEM = ca, signer, caPEM
+	return nil
+}
+
+func (p *Pki) createCA() error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return errors.Wrapf(err, "cannot generate ca key")
+	}
+	hostname, _ := os.Hostname()
+	tmpl := &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "k8sinit ca " + hostname},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(caValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, ca, err := sign(tmpl, key, nil, nil)
+	if err != nil {
+		return errors.Wrapf(err, "cannot create ca")
+	}
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	if err := writeKeyPair(p.path(CACertFilename), p.path(CAKeyFilename), caPEM, key); err != nil {
+		return err
+	}
+	p.ca, p.caKey, p.caPEM = ca, key, caPEM
+	klog.V(0).Infof("ca %v created", ca.Subject.CommonName)
+	return nil
+}
+
+// sign creates a certificate of tmpl signed by parent, self signed if parent
+// is nil.
+func sign(tmpl *x509.Certificate, key *ecdsa.PrivateKey, parent *x509.Certificate, parentKey crypto.Signer) ([]byte, *x509.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 127))
+	if err != nil {
+		return nil, nil, err
+	}
+	tmpl.SerialNumber = serial
+	if parent == nil {
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, key.Public(), parentKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	return der, cert, err
+}
+
+func writeFile(path string, data []byte, perm os.FileMode) error {
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, perm); err != nil {
+		return errors.Wrapf(err, "cannot write %v", tmp)
+	}
+	return os.Rename(tmp, path)
+}
+
+func writeKeyPair(certFile, keyFile string, certPEM []byte, key interface{}) error {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return errors.Wrapf(err, "cannot encode key")
+	}
+	if err := writeFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		return err
+	}
+	return writeFile(certFile, certPEM, 0644)
+}
+
+// serverNames returns the names and addresses the server certificate is
+// valid for, the hostname and the addresses of all interfaces.
+func serverNames() ([]string, []net.IP) {
+	names := []string{"localhost"}
+	if hostname, err := os.Hostname(); err == nil && hostname != "" && hostname != "localhost" {
+		names = append(names, hostname)
+	}
+	var ips []net.IP
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		klog.V(0).Error(err, "cannot list interface addresses")
+	}
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && !ipnet.IP.IsLinkLocalUnicast() {
+			ips = append(ips, ipnet.IP)
+		}
+	}
+	return names, ips
+}
+
+// RotateServerCertificate issues a new server certificate from the ca for
+// the current names and addresses of the system.
+func (p *Pki) RotateServerCertificate() (CertificateInfo, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return CertificateInfo{}, errors.Wrapf(err, "cannot generate server key")
+	}
+	names, ips := serverNames()
+	tmpl := &x509.Certificate{
+		Subject:     pkix.Name{CommonName: names[len(names)-1]},
+		NotBefore:   time.Now().Add(-time.Hour),
+		NotAfter:    time.Now().Add(certValidity),
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:    names,
+		IPAddresses: ips,
+	}
+	der, leaf, err := sign(tmpl, key, p.ca, p.caKey)
+	if err != nil {
+		return CertificateInfo{}, errors.Wrapf(err, "cannot create server certificate")
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	certPEM = append(certPEM, p.caPEM...)
+	if err := writeKeyPair(p.path(CertFilename), p.path(KeyFilename), certPEM, key); err != nil {
+		return CertificateInfo{}, err
+	}
+	cert := &tls.Certificate{Certificate: [][]byte{der, p.ca.Raw}, PrivateKey: key, Leaf: leaf}
+	p.mu.Lock()
+	p.cert = cert
+	p.mu.Unlock()
+	klog.V(0).Infof("server certificate issued for %v %v", names, ips)
+	return certificateInfo(leaf), nil
+}
+
+// ReplaceServerCertificate installs a certificate issued elsewhere. data is
+// a pem bundle of the certificate chain and the private key.
+func (p *Pki) ReplaceServerCertificate(data []byte) (CertificateInfo, error) {
+	cert, err := tls.X509KeyPair(data, data)
+	if err != nil {
+		return CertificateInfo{}, errors.Wrapf(InvalidCertificateError, "%v", err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return CertificateInfo{}, errors.Wrapf(InvalidCertificateError, "%v", err)
+	}
+	now := time.Now()
+	if now.Before(leaf.NotBefore) || now.After(leaf.NotAfter) {
+		return CertificateInfo{}, errors.Wrapf(InvalidCertificateError, "certificate is not valid now")
+	}
+	cert.Leaf = leaf
+	var certPEM []byte
+	for _, der := range cert.Certificate {
+		certPEM = append(certPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	}
+	if err := writeKeyPair(p.path(CertFilename), p.path(KeyFilename), certPEM, cert.PrivateKey); err != nil {
+		return CertificateInfo{}, err
+	}
+	p.mu.Lock()
+	p.cert = &cert
+	p.mu.Unlock()
+	klog.V(0).Infof("server certificate replaced with %v", leaf.Subject)
+	return certificateInfo(leaf), nil
+}
+
+// GetCertificate is the tls.Config callback serving the current server
+// certificate.
+func (p *Pki) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.cert == nil {
+		return nil, PkiNotReadyError
+	}
+	return p.cert, nil
+}
+
+// CACertificate returns the pem encoded ca certificate.
+func (p *Pki) CACertificate() []byte {
+	return p.caPEM
+}
+
+func (p *Pki) ServerCertificateInfo() CertificateInfo {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	leaf := p.cert.Leaf
+	if leaf == nil {
+		leaf, _ = x509.ParseCertificate(p.cert.Certificate[0])
+	}
+	return certificateInfo(leaf)
+}
+
+func (p *Pki) CACertificateInfo() CertificateInfo {
+	return certificateInfo(p.ca)
+}
+
+func certificateInfo(c *x509.Certificate) CertificateInfo {
+	if c == nil {
+		return CertificateInfo{}
+	}
+	sum := sha256.Sum256(c.Raw)
+	info := CertificateInfo{
+		Subject:     c.Subject.String(),
+		Issuer:      c.Issuer.String(),
+		DNSNames:    append([]string{}, c.DNSNames...),
+		IPAddresses: []string{},
+		NotBefore:   c.NotBefore,
+		NotAfter:    c.NotAfter,
+		SHA256:      hex.EncodeToString(sum[:]),
+	}
+	for _, ip := range c.IPAddresses {
+		info.IPAddresses = append(info.IPAddresses, ip.String())
+	}
+	return info
+}
+
+// Install copies the certificates in use into the pool, browsers trusting
+// the ca of the installer keep trusting the installed system.
+func (p *Pki) Install(poolName string) error {
+	dir := Dir(poolName)
+	if dir == p.dir {
+		return nil
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return errors.Wrapf(err, "cannot create %v", dir)
+	}
+	for _, filename := range []string{CACertFilename, CAKeyFilename, CertFilename, KeyFilename} {
+		data, err := ioutil.ReadFile(p.path(filename))
+		if err != nil {
+			return errors.Wrapf(err, "cannot read %v", filename)
+		}
+		perm := os.FileMode(0644)
+		if filename == CAKeyFilename || filename == KeyFilename {
+			perm = 0600
+		}
+		if err := writeFile(filepath.Join(dir, filename), data, perm); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -159,6 +159,14 @@ func createZfs(part, poolname string, output io.Writer) error {
 		output.Write([]byte("create config dataset failed\n"))
 		return errors.Wrapf(err, "create config dataset failed")
 	}
+	if _, err = zfs.CreateFilesystem(poolname+"/uploads", nil); err != nil {
+		output.Write([]byte("create uploads dataset failed\n"))
+		return errors.Wrapf(err, "create uploads dataset failed")
+	}
+	if _, err = zfs.CreateFilesystem(poolname+"/audit", nil); err != nil {
+		output.Write([]byte("create audit dataset failed\n"))
+		return errors.Wrapf(err, "create audit dataset failed")
+	}
 	output.Write([]byte("creating zfs on " + part + " with name " + poolname + " succeed\n"))
 	return nil
 }
@@ -61,6 +61,11 @@ func reapProcs() {
 
 func stopSystem() {
 	managementServicesStopper.StopAll()
+	// the sync loop must not step the clock while it is saved
+	if ts := GetTimeSync(); ts != nil {
+		ts.Stop()
+	}
+	writeRtc()
 	writeRandomSeed()
 	CloseZpools()
 	reapProcs()
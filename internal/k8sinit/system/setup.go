@@ -21,6 +21,8 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/kazimsarikaya/k8sinit/internal/k8sinit"
+	"github.com/kazimsarikaya/k8sinit/internal/k8sinit/auth"
+	"github.com/kazimsarikaya/k8sinit/internal/k8sinit/pki"
 	"github.com/pkg/errors"
 	"golang.org/x/sys/unix"
 	"io"
@@ -67,6 +69,17 @@ func InstallSystem(config k8sinit.InstallConfig, output io.WriteCloser) error {
 	defer output.Close()
 	klog.V(0).Infof("starting install")
 	output.Write([]byte("starting install\n"))
+	if err := config.Validate(); err != nil {
+		klog.V(0).Error(err, "bad install config")
+		output.Write([]byte(err.Error() + "\n"))
+		return errors.Wrapf(err, "bad install config")
+	}
+	// check the password before the disk is touched
+	if _, err := auth.HashPassword(config.AdminPassword); err != nil {
+		klog.V(0).Error(err, "bad admin password")
+		output.Write([]byte("bad admin password: " + err.Error() + "\n"))
+		return errors.Wrapf(err, "bad admin password")
+	}
 	err := apkInstallPacketWithOutput("grub-bios", output)
 	if err != nil {
 		klog.V(0).Error(err, "cannot install apk deps")
@@ -116,10 +129,23 @@ func InstallSystem(config k8sinit.InstallConfig, output io.WriteCloser) error {
 		klog.V(0).Error(err, "cannot install grub")
 		return err
 	}
+	output.Write([]byte("writing admin credential\n"))
+	if err = auth.WriteCredential(config.PoolName, config.AdminPassword); err != nil {
+		klog.V(0).Error(err, "cannot write admin credential")
+		return errors.Wrapf(err, "cannot write admin credential")
+	}
+	config.AdminPassword = ""
 	if err = WriteConfig(config); err != nil {
 		klog.V(0).Error(err, "config write failed")
 		return errors.Wrapf(err, "config write failed")
 	}
+	if p := pki.GetPki(); p != nil {
+		output.Write([]byte("installing tls certificates\n"))
+		if err = p.Install(config.PoolName); err != nil {
+			klog.V(0).Error(err, "cannot install tls certificates")
+			return errors.Wrapf(err, "cannot install tls certificates")
+		}
+	}
 	klog.V(0).Infof("installtion ended")
 	output.Write([]byte("installation ended\neject cdrom and reboot\n"))
 	return nil
@@ -170,7 +196,7 @@ func ReadConfig() (*k8sinit.InstallConfig, error) {
 func GetRole() string {
 	found, role, _ := GetKernelParameterValue("k8sinit.role")
 	if !found {
-		role = "node"
+		role = k8sinit.RoleNode
 	}
 	return role.(string)
 }
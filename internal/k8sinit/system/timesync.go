@@ -0,0 +1,268 @@
+/*
+Copyright 2020 Kazım SARIKAYA
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package system
+
+import (
+	"github.com/kazimsarikaya/k8sinit/internal/k8sinit"
+	"github.com/kazimsarikaya/k8sinit/internal/k8sinit/network"
+	"github.com/kazimsarikaya/k8sinit/internal/k8sinit/network/ntp"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+	klog "k8s.io/klog/v2"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultNtpServer = "pool.ntp.org"
+
+	// offsets above it are stepped, smaller ones are slewed
+	timeStepThreshold = 128 * time.Millisecond
+	minTimeSyncPoll   = 64 * time.Second
+	maxTimeSyncPoll   = 1024 * time.Second
+	ntpQueryTimeout   = 5 * time.Second
+
+	// adjtimex modes and status bits
+	adjMaxError         = 0x0004
+	adjEstError         = 0x0008
+	adjStatus           = 0x0010
+	adjOffsetSingleshot = 0x8001
+	staUnsync           = 0x0040
+)
+
+// TimeSyncStatus is the state of the clock sync. Offset and Delay are in
+// microseconds and belong to the last successful sync.
+type TimeSyncStatus struct {
+	Synced    bool       `json:"synced"`
+	Servers   []string   `json:"servers"`
+	Server    string     `json:"server,omitempty"`
+	Stratum   uint8      `json:"stratum,omitempty"`
+	Offset    int64      `json:"offset"`
+	Delay     int64      `json:"delay"`
+	Stepped   bool       `json:"stepped"`
+	LastSync  *time.Time `json:"lastsync,omitempty"`
+	LastError string     `json:"lasterror,omitempty"`
+}
+
+// TimeSync keeps the system clock in sync with ntp servers. The servers are
+// the configured ones, else the ones sent by dhcp, else DefaultNtpServer.
+type TimeSync struct {
+	configured []string
+	mu         sync.Mutex
+	status     TimeSyncStatus
+	stop       chan struct{}
+	stopOnce   sync.Once
+	wg         *sync.WaitGroup
+}
+
+var singletonTimeSync *TimeSync = nil
+
+func StartTimeSync(ic *k8sinit.InstallConfig) *TimeSync {
+	if singletonTimeSync != nil {
+		return singletonTimeSync
+	}
+	var wg sync.WaitGroup
+	ts := &TimeSync{
+		stop: make(chan struct{}),
+		wg:   &wg,
+	}
+	if ic != nil {
+		ts.configured = ic.NtpServers
+	}
+	ts.wg.Add(1)
+	go ts.run()
+	singletonTimeSync = ts
+	return ts
+}
+
+func GetTimeSync() *TimeSync {
+	return singletonTimeSync
+}
+
+func (ts *TimeSync) Status() TimeSyncStatus {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	st := ts.status
+	st.Synced = st.Synced && kernelClockSynced()
+	return st
+}
+
+// Stop ends the sync loop and waits for a running sync, so the clock is not
+// stepped afterwards.
+func (ts *TimeSync) Stop() {
+	ts.stopOnce.Do(func() { close(ts.stop) })
+	ts.wg.Wait()
+}
+
+func (ts *TimeSync) servers() []string {
+	if len(ts.configured) > 0 {
+		return ts.configured
+	}
+	if servers := network.DhcpNtpServers(); len(servers) > 0 {
+		return servers
+	}
+	return []string{DefaultNtpServer}
+}
+
+func (ts *TimeSync) run() {
+	defer ts.wg.Done()
+	poll := minTimeSyncPoll
+	for {
+		if err := ts.sync(); err != nil {
+			klog.V(0).Error(err, "cannot sync clock")
+			poll = minTimeSyncPoll
+		} else if poll < maxTimeSyncPoll {
+			poll *= 2
+		}
+		select {
+		case <-ts.stop:
+			return
+		case <-time.After(poll):
+		}
+	}
+}
+
+// sync queries all servers and corrects the clock with the answer of the
+// nearest one.
+func (ts *TimeSync) sync() error {
+	servers := ts.servers()
+	var best *ntp.Response
+	var lastErr error
+	for _, server := range servers {
+		resp, err := ntp.Query(server, ntpQueryTimeout)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if best == nil || resp.Delay < best.Delay {
+			best = resp
+		}
+	}
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.status.Servers = servers
+	if best == nil {
+		if lastErr == nil {
+			lastErr = errors.New("no ntp server")
+		}
+		ts.status.LastError = lastErr.Error()
+		return lastErr
+	}
+	stepped, err := adjustClock(best.Offset)
+	if err == nil {
+		err = markClockSynced(best.RootDispersion+best.RootDelay/2+best.Delay/2, best.Offset)
+	}
+	if err != nil {
+		ts.status.LastError = err.Error()
+		return err
+	}
+	now := time.Now()
+	ts.status = TimeSyncStatus{
+		Synced:   true,
+		Servers:  servers,
+		Server:   best.Server.String(),
+		Stratum:  best.Stratum,
+		Offset:   int64(best.Offset / time.Microsecond),
+		Delay:    int64(best.Delay / time.Microsecond),
+		Stepped:  stepped,
+		LastSync: &now,
+	}
+	if s := ntp.GetNonBlockingNtpServer(); s != nil {
+		s.SetReference(best.Server, best.Stratum, best.RootDelay+best.Delay, best.RootDispersion, now)
+	}
+	klog.V(5).Infof("clock synced with %v offset %v stepped %v", best.Server, best.Offset, stepped)
+	return nil
+}
+
+// adjustClock steps the clock for big offsets and slews it for small ones.
+func adjustClock(offset time.Duration) (bool, error) {
+	if offset > timeStepThreshold || offset < -timeStepThreshold {
+		tv := unix.NsecToTimeval(time.Now().Add(offset).UnixNano())
+		if err := unix.Settimeofday(&tv); err != nil {
+			return true, errors.Wrapf(err, "cannot step clock")
+		}
+		return true, nil
+	}
+	tx := unix.Timex{Modes: adjOffsetSingleshot, Offset: int64(offset / time.Microsecond)}
+	if _, err := unix.Adjtimex(&tx); err != nil {
+		return false, errors.Wrapf(err, "cannot slew clock")
+	}
+	return false, nil
+}
+
+// markClockSynced clears the unsync flag of the kernel clock so the kernel
+// tracks its error and the ntp server announces it as synced.
+func markClockSynced(maxError, estError time.Duration) error {
+	var tx unix.Timex
+	if _, err := unix.Adjtimex(&tx); err != nil {
+		return errors.Wrapf(err, "cannot get kernel clock state")
+	}
+	if estError < 0 {
+		estError = -estError
+	}
+	tx.Modes = adjStatus | adjMaxError | adjEstError
+	tx.Status &^= staUnsync
+	tx.Maxerror = int64(maxError / time.Microsecond)
+	tx.Esterror = int64(estError / time.Microsecond)
+	if _, err := unix.Adjtimex(&tx); err != nil {
+		return errors.Wrapf(err, "cannot set kernel clock state")
+	}
+	return nil
+}
+
+func kernelClockSynced() bool {
+	var tx unix.Timex
+	state, err := unix.Adjtimex(&tx)
+	return err == nil && state != unix.TIME_ERROR && tx.Status&staUnsync == 0
+}
+
+// writeRtc saves the system clock to the rtc in utc if it was synced.
+func writeRtc() {
+	if singletonTimeSync == nil || !singletonTimeSync.Status().Synced {
+		return
+	}
+	var f *os.File
+	var err error
+	for _, dev := range []string{"/dev/rtc0", "/dev/rtc"} {
+		if f, err = os.Open(dev); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		klog.V(0).Error(err, "cannot open rtc")
+		return
+	}
+	defer f.Close()
+	now := time.Now().UTC()
+	rt := &unix.RTCTime{
+		Sec:   int32(now.Second()),
+		Min:   int32(now.Minute()),
+		Hour:  int32(now.Hour()),
+		Mday:  int32(now.Day()),
+		Mon:   int32(now.Month()) - 1,
+		Year:  int32(now.Year()) - 1900,
+		Wday:  int32(now.Weekday()),
+		Yday:  int32(now.YearDay()) - 1,
+		Isdst: 0,
+	}
+	if err := unix.IoctlSetRTCTime(int(f.Fd()), rt); err != nil {
+		klog.V(0).Error(err, "cannot write rtc")
+		return
+	}
+	klog.V(0).Infof("rtc set to %v", now)
+}
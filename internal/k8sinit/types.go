@@ -17,16 +17,103 @@ limitations under the License.
 package k8sinit
 
 type InstallConfig struct {
-	Disk                       string `json:"disk"`
-	Force                      bool   `json:"force"`
-	PoolName                   string `json:"poolname"`
-	ExternalNetwork            string `json:"extnet"`
-	IsExternalNetworkStatic    bool   `json:"extnettype"`
-	ExternalNetworkIPAndPrefix string `json:"extnetip"`
-	ExternalNetworkGateway     string `json:"extnetgw"`
-	AdminNetwork               string `json:"adminnet"`
-	IsAdminNetworkStatic       bool   `json:"adminnettype"`
-	AdminNetworkIPAndPrefix    string `json:"adminnetip"`
-	InternalNetwork            string `json:"internalnet"`
-	InternalNetworkIPAndPrefix string `json:"internalnetip"`
+	Disk                       string     `json:"disk"`
+	Force                      bool       `json:"force"`
+	PoolName                   string     `json:"poolname"`
+	ExternalNetwork            string     `json:"extnet"`
+	IsExternalNetworkStatic    bool       `json:"extnettype"`
+	ExternalNetworkIPAndPrefix string     `json:"extnetip"`
+	ExternalNetworkGateway     string     `json:"extnetgw"`
+	AdminNetwork               string     `json:"adminnet"`
+	IsAdminNetworkStatic       bool       `json:"adminnettype"`
+	AdminNetworkIPAndPrefix    string     `json:"adminnetip"`
+	InternalNetwork            string     `json:"internalnet"`
+	InternalNetworkIPAndPrefix string     `json:"internalnetip"`
+	Dhcp                       DhcpConfig `json:"dhcp"`
+	Nat                        NatConfig  `json:"nat"`
+	NtpServers                 []string   `json:"ntpservers,omitempty"`
+	IpxeRefresh                bool       `json:"ipxerefresh,omitempty"`
+	// IpxeSums pins the sha256 of the ipxe binaries IpxeRefresh downloads,
+	// a binary without a pin is not refreshed
+	IpxeSums map[string]string `json:"ipxesums,omitempty"`
+	Tftp     TftpConfig        `json:"tftp"`
+	Audit    AuditConfig       `json:"audit"`
+	Http     HttpConfig        `json:"http"`
+	// AdminPassword is only sent to the installer, it is stored hashed
+	// apart from the config
+	AdminPassword string `json:"adminpassword,omitempty"`
+}
+
+// TftpConfig configures the tftp server. Root defaults to the tftp directory
+// of the pool. With Uploads clients may write files into their own
+// directory of the uploads dataset. UploadQuota limits the bytes stored for
+// a client and MaxUploadSize a single file.
+type TftpConfig struct {
+	Root          string `json:"root,omitempty"`
+	Uploads       bool   `json:"uploads,omitempty"`
+	UploadQuota   int64  `json:"uploadquota,omitempty"`
+	MaxUploadSize int64  `json:"maxuploadsize,omitempty"`
+}
+
+// HttpConfig configures the addresses of the management server. The api and
+// the ui are served over https on AdminAddresses, on the admin network
+// interface when empty. Boot files are served over http on BootAddresses,
+// on the internal network address when empty. At most MaxBootTransfers boot
+// files are sent at once while up to MaxBootQueue requests wait.
+type HttpConfig struct {
+	AdminAddresses   []string `json:"adminaddresses,omitempty"`
+	BootAddresses    []string `json:"bootaddresses,omitempty"`
+	MaxBootTransfers int      `json:"maxboottransfers,omitempty"`
+	MaxBootQueue     int      `json:"maxbootqueue,omitempty"`
+}
+
+// Listener is an address to listen on. A listener with a Device only
+// accepts connections arriving on that interface, so it also works for
+// addresses assigned by dhcp.
+type Listener struct {
+	IP     string
+	Device string
+}
+
+// AuditConfig configures rotation of the audit log. MaxSize is the size in
+// bytes a log file is rotated at, MaxFiles the number of rotated files kept.
+type AuditConfig struct {
+	MaxSize  int64 `json:"maxsize,omitempty"`
+	MaxFiles int   `json:"maxfiles,omitempty"`
+}
+
+// NatConfig configures routing of the internal network out through the
+// external network. It is on unless disabled.
+type NatConfig struct {
+	Disabled bool `json:"disabled,omitempty"`
+}
+
+// DhcpConfig configures a dhcp scope. Empty fields get defaults derived from
+// the subnet of the scope. LeaseTime is in seconds. HostnameTemplate is a
+// text/template rendered with HostnameData for clients without a reserved
+// hostname.
+type DhcpConfig struct {
+	RangeStart       string       `json:"rangestart,omitempty"`
+	RangeEnd         string       `json:"rangeend,omitempty"`
+	LeaseTime        int          `json:"leasetime,omitempty"`
+	DomainName       string       `json:"domainname,omitempty"`
+	SearchDomains    []string     `json:"searchdomains,omitempty"`
+	HostnameTemplate string       `json:"hostnametemplate,omitempty"`
+	Router           string       `json:"router,omitempty"`
+	DNS              []string     `json:"dns,omitempty"`
+	NTP              []string     `json:"ntp,omitempty"`
+	Options          []DhcpOption `json:"options,omitempty"`
+}
+
+// HostnameData is the input of dhcp hostname templates. MAC is the mac
+// address of the client without separators, MacSuffix its last three octets.
+type HostnameData struct {
+	MAC       string
+	MacSuffix string
+}
+
+// DhcpOption is a raw dhcp option, its value is sent as is.
+type DhcpOption struct {
+	Code  uint8  `json:"code"`
+	Value string `json:"value"`
 }